@@ -6,7 +6,9 @@ require (
 	github.com/aws/aws-sdk-go v1.40.43
 	github.com/aws/aws-sdk-go-v2 v1.9.0
 	github.com/aws/aws-sdk-go-v2/config v1.8.1
-	github.com/aws/aws-sdk-go-v2/credentials v1.4.1 // indirect
+	github.com/aws/aws-sdk-go-v2/credentials v1.4.1
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.15.1
+	github.com/aws/aws-sdk-go-v2/service/sts v1.7.0
+	github.com/aws/smithy-go v1.8.0
 	github.com/grafana/grafana-plugin-sdk-go v0.113.0
 )
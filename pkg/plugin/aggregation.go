@@ -0,0 +1,165 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Intervals that partitions can be grouped by. intervalRaw keeps one point per
+// rendered prefix, i.e. the granularity of the prefix template.
+const (
+	intervalRaw   = "raw"
+	intervalHour  = "hour"
+	intervalDay   = "day"
+	intervalWeek  = "week"
+	intervalMonth = "month"
+)
+
+// Aggregations that combine the values of the partitions within an interval.
+const (
+	aggregationSum  = "sum"
+	aggregationAvg  = "avg"
+	aggregationMin  = "min"
+	aggregationMax  = "max"
+	aggregationLast = "last"
+	// aggregationMerge merges the partitions of an interval into one before
+	// computing the metric, e.g. the average object size of the interval
+	// rather than the average of the partitions' averages.
+	aggregationMerge = "merge"
+)
+
+var aggregations = map[string]func(values []float64) float64{
+	aggregationSum: func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	aggregationAvg: func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	},
+	aggregationMin: func(values []float64) float64 {
+		min := values[0]
+		for _, v := range values[1:] {
+			if v < min {
+				min = v
+			}
+		}
+		return min
+	},
+	aggregationMax: func(values []float64) float64 {
+		max := values[0]
+		for _, v := range values[1:] {
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	},
+	aggregationLast: func(values []float64) float64 {
+		return values[len(values)-1]
+	},
+}
+
+func validateAggregation(interval, aggregation string) error {
+	switch interval {
+	case intervalRaw, intervalHour, intervalDay, intervalWeek, intervalMonth:
+	default:
+		return fmt.Errorf("unknown aggregation interval %q", interval)
+	}
+	if _, ok := aggregations[aggregation]; !ok && aggregation != aggregationMerge {
+		return fmt.Errorf("unknown aggregation %q", aggregation)
+	}
+	return nil
+}
+
+// intervalStart returns the start of the interval containing t. Weeks start
+// on Monday.
+func intervalStart(t time.Time, interval string) time.Time {
+	switch interval {
+	case intervalHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case intervalDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case intervalWeek:
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, t.Location())
+	case intervalMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return t
+	}
+}
+
+// groupByInterval groups time-ordered partitions by interval. It returns,
+// for each group, the time of its first partition and the indices of its
+// partitions.
+func groupByInterval(times []time.Time, interval string) ([]time.Time, [][]int) {
+	groupTimes := []time.Time{}
+	groups := [][]int{}
+
+	var groupStart time.Time
+	for i, t := range times {
+		start := intervalStart(t, interval)
+		if len(groups) == 0 || !start.Equal(groupStart) {
+			groupTimes = append(groupTimes, t)
+			groups = append(groups, nil)
+			groupStart = start
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], i)
+	}
+	return groupTimes, groups
+}
+
+// aggregate groups time-ordered partition values by interval and combines
+// each group with aggregation. Every group, including the last one, is
+// emitted at the time of its first partition. NaN values, which stand for
+// partitions without a value, are left out; a group of only NaN values is NaN.
+func aggregate(times []time.Time, values []float64, interval string, aggregation string) ([]time.Time, []float64) {
+	combine := aggregations[aggregation]
+	groupTimes, groups := groupByInterval(times, interval)
+	outValues := make([]float64, len(groups))
+	for g, group := range groups {
+		groupValues := make([]float64, 0, len(group))
+		for _, i := range group {
+			if !math.IsNaN(values[i]) {
+				groupValues = append(groupValues, values[i])
+			}
+		}
+		if len(groupValues) == 0 {
+			outValues[g] = math.NaN()
+			continue
+		}
+		outValues[g] = combine(groupValues)
+	}
+	return groupTimes, outValues
+}
+
+// aggregateMetric computes m over time-ordered partitions, aggregated by
+// interval.
+func aggregateMetric(times []time.Time, infos []*partitionInfo, m metric, interval string, aggregation string) ([]time.Time, []float64) {
+	if aggregation == aggregationMerge {
+		groupTimes, groups := groupByInterval(times, interval)
+		values := make([]float64, len(groups))
+		for g, group := range groups {
+			merged := &partitionInfo{}
+			for _, i := range group {
+				merged.add(infos[i])
+			}
+			values[g] = m.Value(merged, groupTimes[g])
+		}
+		return groupTimes, values
+	}
+
+	values := make([]float64, len(infos))
+	for i, info := range infos {
+		values[i] = m.Value(info, times[i])
+	}
+	return aggregate(times, values, interval, aggregation)
+}
@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCacheMaxEntries bounds the number of cached partition listings.
+	defaultCacheMaxEntries = 10000
+	// defaultOpenPartitionTTL applies to partitions that overlap "now" and may still grow.
+	defaultOpenPartitionTTL = time.Minute
+	// defaultClosedPartitionTTL applies to partitions that ended in the past.
+	defaultClosedPartitionTTL = time.Hour
+)
+
+type partitionCacheKey struct {
+	Bucket string
+	Prefix string
+	// Listings keeps apart the summaries made of different listings.
+	Listings listings
+	// RequesterPays and ExpectedBucketOwner keep apart listings made on
+	// behalf of different payers and owners, which S3 may answer differently.
+	RequesterPays       bool
+	ExpectedBucketOwner string
+}
+
+func newPartitionCacheKey(bucket, prefix string, options listingOptions) partitionCacheKey {
+	return partitionCacheKey{
+		Bucket:              bucket,
+		Prefix:              prefix,
+		Listings:            options.listings(),
+		RequesterPays:       options.RequesterPays,
+		ExpectedBucketOwner: options.ExpectedBucketOwner,
+	}
+}
+
+type partitionCacheEntry struct {
+	key     partitionCacheKey
+	info    *partitionInfo
+	expires time.Time
+}
+
+// partitionCache is a size-bounded LRU cache of partition listings whose
+// entries also expire after a per-entry TTL. A nil *partitionCache is a valid,
+// always-empty cache.
+type partitionCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	lru        *list.List
+	entries    map[partitionCacheKey]*list.Element
+	now        func() time.Time
+}
+
+func newPartitionCache(maxEntries int) *partitionCache {
+	return &partitionCache{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[partitionCacheKey]*list.Element),
+		now:        time.Now,
+	}
+}
+
+func (c *partitionCache) get(key partitionCacheKey) (*partitionInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*partitionCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.info, true
+}
+
+func (c *partitionCache) add(key partitionCacheKey, info *partitionInfo, ttl time.Duration) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*partitionCacheEntry)
+		entry.info = info
+		entry.expires = expires
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&partitionCacheEntry{key: key, info: info, expires: expires})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*partitionCacheEntry).key)
+	}
+}
+
+func (c *partitionCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *partitionCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[partitionCacheKey]*list.Element)
+}
+
+// partitionTTL picks how long a listing of the partition starting at start
+// and spanning granularity may be cached: partitions still open at now can
+// receive new objects and are only cached briefly.
+func partitionTTL(start time.Time, granularity time.Duration, now time.Time, open, closed time.Duration) time.Duration {
+	if start.Add(granularity).After(now) {
+		return open
+	}
+	return closed
+}
@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// defaultRoleSessionName names the sessions of assumed roles unless
+	// the datasource JSON sets one.
+	defaultRoleSessionName = "grafana-s3-datasource"
+	// credentialsExpiryWindow refreshes temporary credentials this long
+	// before they expire.
+	credentialsExpiryWindow = 5 * time.Minute
+)
+
+// getCredentialsProviderFunc returns the load option that installs the
+// configured credentials. Providers that call STS build their client from
+// loadOptions, which carry the region and endpoint settings.
+func getCredentialsProviderFunc(ctx context.Context, dsConfig dataSourceConfig, secureData map[string]string, loadOptions ...func(*config.LoadOptions) error) (config.LoadOptionsFunc, error) {
+	switch dsConfig.AuthenticationProvider {
+	case authProviderKeys:
+		return staticCredentialsProviderFunc(dsConfig, secureData), nil
+	case authProviderAssumeRole:
+		base := DummyLoadOptionsFunc()
+		if dsConfig.AssumeRoleBaseProvider == authProviderKeys {
+			base = staticCredentialsProviderFunc(dsConfig, secureData)
+		}
+		baseConfig, err := config.LoadDefaultConfig(ctx, append(loadOptions, base)...)
+		if err != nil {
+			return nil, err
+		}
+		log.DefaultLogger.Info("Assuming role", "roleArn", dsConfig.AssumeRoleArn, "baseProvider", dsConfig.AssumeRoleBaseProvider)
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(baseConfig), dsConfig.AssumeRoleArn, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = dsConfig.roleSessionName()
+			if dsConfig.AssumeRoleDuration > 0 {
+				o.Duration = time.Duration(dsConfig.AssumeRoleDuration) * time.Second
+			}
+			if dsConfig.ExternalId != "" {
+				o.ExternalID = aws.String(dsConfig.ExternalId)
+			}
+		})
+		return cachedCredentialsProviderFunc(provider), nil
+	case authProviderSharedConfig:
+		return sharedConfigProviderFunc(ctx, dsConfig)
+	case authProviderWebIdentity:
+		stsConfig, err := config.LoadDefaultConfig(ctx, append(loadOptions, config.WithCredentialsProvider(aws.AnonymousCredentials{}))...)
+		if err != nil {
+			return nil, err
+		}
+		tokenFile, roleArn := dsConfig.webIdentity()
+		log.DefaultLogger.Info("Assuming role with web identity", "roleArn", roleArn, "tokenFile", tokenFile)
+		provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(stsConfig), roleArn, stscreds.IdentityTokenFile(tokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = dsConfig.roleSessionName()
+		})
+		return cachedCredentialsProviderFunc(provider), nil
+	}
+	return DummyLoadOptionsFunc(), nil
+}
+
+func staticCredentialsProviderFunc(dsConfig dataSourceConfig, secureData map[string]string) config.LoadOptionsFunc {
+	secretAccessKey, hasSecretAccessKey := secureData["secretAccessKey"]
+	if hasSecretAccessKey {
+		if _, secureAccessKeyID := secureData["accessKeyId"]; secureAccessKeyID {
+			log.DefaultLogger.Info("Adding secretAccessKey for secure access key")
+		} else {
+			log.DefaultLogger.Info("Adding secretAccessKey for access key", "AccessKeyID", dsConfig.AccessKeyId)
+		}
+	}
+	provider := credentials.NewStaticCredentialsProvider(dsConfig.accessKeyID(secureData), secretAccessKey, secureData["sessionToken"])
+
+	// validateKeys has already rejected malformed expirations.
+	expires, _ := dsConfig.sessionTokenExpiry()
+	if !expires.IsZero() {
+		return config.WithCredentialsProvider(temporaryCredentialsProvider{provider: provider, expires: expires})
+	}
+	return config.WithCredentialsProvider(provider)
+}
+
+// temporaryCredentialsProvider marks static credentials as expiring at a
+// known time, e.g. session credentials issued by STS and pasted into the
+// datasource settings.
+type temporaryCredentialsProvider struct {
+	provider credentials.StaticCredentialsProvider
+	expires  time.Time
+}
+
+func (p temporaryCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	creds, err := p.provider.Retrieve(ctx)
+	if err != nil {
+		return creds, err
+	}
+	creds.CanExpire = true
+	creds.Expires = p.expires
+	return creds, nil
+}
+
+// sharedConfigProviderFunc selects the configured profile and, optionally,
+// custom shared credentials and config files. Unlike the SDK, which silently
+// falls back to the default chain, it fails when the profile does not exist.
+func sharedConfigProviderFunc(ctx context.Context, dsConfig dataSourceConfig) (config.LoadOptionsFunc, error) {
+	_, err := config.LoadSharedConfigProfile(ctx, dsConfig.Profile, func(o *config.LoadSharedConfigOptions) {
+		if dsConfig.CredentialsFile != "" {
+			o.CredentialsFiles = []string{dsConfig.CredentialsFile}
+		}
+		if dsConfig.ConfigFile != "" {
+			o.ConfigFiles = []string{dsConfig.ConfigFile}
+		}
+	})
+	if err != nil {
+		return nil, &ConfigError{Field: "profile", Reason: fmt.Sprintf("cannot load profile %q", dsConfig.Profile), Err: err}
+	}
+
+	log.DefaultLogger.Info("Using shared config profile", "profile", dsConfig.Profile, "credentialsFile", dsConfig.CredentialsFile, "configFile", dsConfig.ConfigFile)
+	optFns := []config.LoadOptionsFunc{config.WithSharedConfigProfile(dsConfig.Profile)}
+	if dsConfig.CredentialsFile != "" {
+		optFns = append(optFns, config.WithSharedCredentialsFiles([]string{dsConfig.CredentialsFile}))
+	}
+	if dsConfig.ConfigFile != "" {
+		optFns = append(optFns, config.WithSharedConfigFiles([]string{dsConfig.ConfigFile}))
+	}
+	return func(o *config.LoadOptions) error {
+		for _, optFn := range optFns {
+			if err := optFn(o); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// cachedCredentialsProviderFunc caches temporary credentials and refreshes
+// them credentialsExpiryWindow before they expire.
+func cachedCredentialsProviderFunc(provider aws.CredentialsProvider) config.LoadOptionsFunc {
+	return config.WithCredentialsProvider(aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = credentialsExpiryWindow
+	}))
+}
+
+func (dsConfig dataSourceConfig) roleSessionName() string {
+	if dsConfig.AssumeRoleSessionName != "" {
+		return dsConfig.AssumeRoleSessionName
+	}
+	return defaultRoleSessionName
+}
+
+func DummyLoadOptionsFunc() config.LoadOptionsFunc {
+	return func(o *config.LoadOptions) error {
+		return nil
+	}
+}
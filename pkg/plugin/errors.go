@@ -0,0 +1,159 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// s3ErrorKind is a coarse, user-facing classification of S3 call failures.
+type s3ErrorKind string
+
+const (
+	errorKindUnknown        s3ErrorKind = "unknown"
+	errorKindCredentials    s3ErrorKind = "invalid_credentials"
+	errorKindUnreachable    s3ErrorKind = "endpoint_unreachable"
+	errorKindAccessDenied   s3ErrorKind = "access_denied"
+	errorKindRegionMismatch s3ErrorKind = "region_mismatch"
+	errorKindNoSuchBucket   s3ErrorKind = "no_such_bucket"
+	errorKindThrottled      s3ErrorKind = "throttled"
+	errorKindRequesterPays  s3ErrorKind = "requester_pays"
+	errorKindTimeout        s3ErrorKind = "timeout"
+	errorKindCanceled       s3ErrorKind = "canceled"
+)
+
+// errorSource tells whether a query failed because of its own input, which the
+// user has to fix, or because of S3, which may fail differently next time.
+type errorSource string
+
+const (
+	errorSourceUser       errorSource = "user"
+	errorSourceDownstream errorSource = "downstream"
+)
+
+// queryError is the error of a query response, tagged with its source.
+type queryError struct {
+	Source errorSource
+	Err    error
+}
+
+func (e *queryError) Error() string {
+	if e.Source == errorSourceUser {
+		return fmt.Sprintf("invalid query: %s", e.Err)
+	}
+	return fmt.Sprintf("S3 request failed (%s): %s", classifyS3Error(e.Err), e.Err)
+}
+
+func (e *queryError) Unwrap() error {
+	return e.Err
+}
+
+// requesterPaysError reports that Err was caused by reading a requester-pays
+// bucket without agreeing to pay for the requests.
+type requesterPaysError struct {
+	Bucket string
+	Err    error
+}
+
+func (e *requesterPaysError) Error() string {
+	return fmt.Sprintf("bucket %s requires requester pays: %s", e.Bucket, e.Err)
+}
+
+func (e *requesterPaysError) Unwrap() error {
+	return e.Err
+}
+
+var errorKindsByCode = map[string]s3ErrorKind{
+	"InvalidAccessKeyId":                 errorKindCredentials,
+	"SignatureDoesNotMatch":              errorKindCredentials,
+	"ExpiredToken":                       errorKindCredentials,
+	"InvalidToken":                       errorKindCredentials,
+	"TokenRefreshRequired":               errorKindCredentials,
+	"AccessDenied":                       errorKindAccessDenied,
+	"AllAccessDisabled":                  errorKindAccessDenied,
+	"AuthorizationHeaderMalformed":       errorKindRegionMismatch,
+	"PermanentRedirect":                  errorKindRegionMismatch,
+	"IllegalLocationConstraintException": errorKindRegionMismatch,
+	"NoSuchBucket":                       errorKindNoSuchBucket,
+	"SlowDown":                           errorKindThrottled,
+	"Throttling":                         errorKindThrottled,
+	"RequestLimitExceeded":               errorKindThrottled,
+}
+
+var errorKindsByStatus = map[int]s3ErrorKind{
+	http.StatusMovedPermanently:   errorKindRegionMismatch,
+	http.StatusForbidden:          errorKindAccessDenied,
+	http.StatusNotFound:           errorKindNoSuchBucket,
+	http.StatusServiceUnavailable: errorKindThrottled,
+}
+
+// classifyS3Error maps an error returned by the S3 client to an s3ErrorKind,
+// looking at requester pays, credential signing, context, transport, API error
+// code and HTTP status in that order. The context comes before the transport
+// because context.DeadlineExceeded is a net.Error too.
+func classifyS3Error(err error) s3ErrorKind {
+	var requesterPaysErr *requesterPaysError
+	if errors.As(err, &requesterPaysErr) {
+		return errorKindRequesterPays
+	}
+
+	var signingErr *v4.SigningError
+	if errors.As(err, &signingErr) {
+		return errorKindCredentials
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorKindTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return errorKindCanceled
+	}
+
+	var sendErr *smithyhttp.RequestSendError
+	var netErr net.Error
+	if errors.As(err, &sendErr) || errors.As(err, &netErr) {
+		return errorKindUnreachable
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if kind, ok := errorKindsByCode[apiErr.ErrorCode()]; ok {
+			return kind
+		}
+	}
+
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) {
+		if kind, ok := errorKindsByStatus[responseErr.HTTPStatusCode()]; ok {
+			return kind
+		}
+	}
+
+	return errorKindUnknown
+}
+
+// s3ErrorCode returns the S3 API error code of err, if any.
+func s3ErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// bucketRegionHint returns the region S3 reported for the bucket in a failed
+// response, if any.
+func bucketRegionHint(err error) string {
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.Response != nil {
+		return responseErr.Response.Header.Get("X-Amz-Bucket-Region")
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// s3HealthAPIClient is implemented by clients that support the calls used by
+// CheckHealth. The *s3.Client built by NewSampleDatasource implements it.
+type s3HealthAPIClient interface {
+	s3.ListObjectsV2APIClient
+	ListBuckets(context.Context, *s3.ListBucketsInput, ...func(*s3.Options)) (*s3.ListBucketsOutput, error)
+	HeadBucket(context.Context, *s3.HeadBucketInput, ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+}
+
+// stsIdentityAPIClient reports the identity the configured credentials resolve to.
+type stsIdentityAPIClient interface {
+	GetCallerIdentity(context.Context, *sts.GetCallerIdentityInput, ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+// callerIdentity returns the ARN of the effective identity, or an empty string
+// when it cannot be determined. It never fails the health check: S3-compatible
+// endpoints commonly have no STS.
+func callerIdentity(ctx context.Context, client stsIdentityAPIClient) string {
+	if client == nil {
+		return ""
+	}
+	output, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.DefaultLogger.Warn("GetCallerIdentity failed", "err", err)
+		return ""
+	}
+	return aws.ToString(output.Arn)
+}
+
+// credentialsExpiryWarning is how long before temporary static credentials
+// expire CheckHealth starts to warn about it.
+const credentialsExpiryWarning = 24 * time.Hour
+
+// staticCredentialsExpiry checks the expiry of temporary static credentials,
+// which cannot be refreshed. It returns an error once they have expired and a
+// warning when they expire within credentialsExpiryWarning.
+func staticCredentialsExpiry(expires time.Time, now time.Time) (string, error) {
+	if expires.IsZero() {
+		return "", nil
+	}
+	remaining := expires.Sub(now)
+	if remaining <= 0 {
+		return "", fmt.Errorf("temporary credentials expired at %s; update the session token", expires.Format(time.RFC3339))
+	}
+	if remaining < credentialsExpiryWarning {
+		return fmt.Sprintf("warning: temporary credentials expire in %s, at %s", remaining.Round(time.Minute), expires.Format(time.RFC3339)), nil
+	}
+	return "", nil
+}
+
+// checkS3Access performs the cheapest authenticated call that proves the
+// configuration works: HeadBucket on the default bucket when one is set,
+// ListBuckets otherwise. A denied HeadBucket has no error code, so a key is
+// listed to tell bad credentials, a wrong region and requester pays apart
+// from a lack of permissions.
+func checkS3Access(ctx context.Context, client s3HealthAPIClient, bucket string, options listingOptions) (string, error) {
+	if bucket == "" {
+		_, err := client.ListBuckets(ctx, &s3.ListBucketsInput{})
+		return "Data source is working", err
+	}
+
+	message := fmt.Sprintf("Data source is working, bucket %q is accessible", bucket)
+	_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket:              aws.String(bucket),
+		ExpectedBucketOwner: options.expectedBucketOwner(),
+	}, options.requestPayerHeader()...)
+	if err != nil && !options.RequesterPays && classifyS3Error(err) == errorKindAccessDenied {
+		// Requester-pays buckets deny requests that do not agree to pay;
+		// tell them apart from a plain lack of permissions.
+		options.RequesterPays = true
+		_, probeErr := listOneKey(ctx, client, bucket, options)
+		if probeErr == nil {
+			return message, &requesterPaysError{Bucket: bucket, Err: err}
+		}
+		switch classifyS3Error(probeErr) {
+		case errorKindCredentials, errorKindRegionMismatch:
+			return message, probeErr
+		}
+	}
+	return message, err
+}
+
+func listOneKey(ctx context.Context, client s3.ListObjectsV2APIClient, bucket string, options listingOptions) (*s3.ListObjectsV2Output, error) {
+	return client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:              aws.String(bucket),
+		MaxKeys:             1,
+		RequestPayer:        options.requestPayer(),
+		ExpectedBucketOwner: options.expectedBucketOwner(),
+	})
+}
+
+// healthCheckFailure turns a failed S3 call into an actionable health check
+// result with the underlying error in the JSON details.
+func healthCheckFailure(err error, bucket string) *backend.CheckHealthResult {
+	kind := classifyS3Error(err)
+
+	var message string
+	switch kind {
+	case errorKindCredentials:
+		message = "Invalid credentials: check the access key ID and secret access key, or the credentials available to the Grafana server"
+	case errorKindUnreachable:
+		message = "Unable to reach the S3 endpoint: check the endpoint URL and that Grafana can connect to it"
+	case errorKindTimeout:
+		message = "The S3 endpoint did not answer in time: check the endpoint URL and the response timeout"
+	case errorKindAccessDenied:
+		if bucket == "" {
+			message = "Access denied: the credentials are not allowed to list buckets; set a default bucket to check bucket access instead"
+		} else {
+			message = fmt.Sprintf("Access denied: the credentials are not allowed to access bucket %q", bucket)
+		}
+	case errorKindRegionMismatch:
+		message = "Region mismatch: the bucket is not in the region the client is configured for"
+		if region := bucketRegionHint(err); region != "" {
+			message = fmt.Sprintf("%s; the bucket is in %s", message, region)
+		}
+	case errorKindNoSuchBucket:
+		if bucket == "" {
+			message = "Not found: the endpoint did not answer like an S3 service; check the endpoint URL and its path"
+		} else {
+			message = fmt.Sprintf("Bucket %q does not exist", bucket)
+		}
+	case errorKindRequesterPays:
+		message = fmt.Sprintf("Bucket %q is a requester-pays bucket: enable Requester pays in the data source or query settings to read it at your expense", bucket)
+	default:
+		message = "S3 health check failed"
+	}
+
+	details, jsonErr := json.Marshal(map[string]string{
+		"errorKind":      string(kind),
+		"errorCode":      s3ErrorCode(err),
+		"verboseMessage": err.Error(),
+	})
+	if jsonErr != nil {
+		log.DefaultLogger.Warn("error marshalling health check details", "err", jsonErr)
+	}
+
+	return &backend.CheckHealthResult{
+		Status:      backend.HealthStatusError,
+		Message:     message,
+		JSONDetails: details,
+	}
+}
+
+// configErrorHealthResult explains why the datasource settings could not
+// produce an S3 client.
+func configErrorHealthResult(err *ConfigError) *backend.CheckHealthResult {
+	details, jsonErr := json.Marshal(map[string]string{
+		"field":          err.Field,
+		"verboseMessage": err.Error(),
+	})
+	if jsonErr != nil {
+		log.DefaultLogger.Warn("error marshalling health check details", "err", jsonErr)
+	}
+
+	return &backend.CheckHealthResult{
+		Status:      backend.HealthStatusError,
+		Message:     err.Error(),
+		JSONDetails: details,
+	}
+}
@@ -0,0 +1,300 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// partitionInfo summarizes the objects listed under a rendered prefix. It
+// can be merged with the summaries of other partitions (see add), so that
+// every metric can be computed over an interval as a whole.
+type partitionInfo struct {
+	Size         int64
+	NumberOfKeys int64
+	// MinSize and MaxSize are only meaningful when NumberOfKeys > 0.
+	MinSize       int64
+	MaxSize       int64
+	SizeHistogram sizeHistogram
+	// Newest and Oldest are the extreme LastModified times of the objects,
+	// zero when there are none.
+	Newest time.Time
+	Oldest time.Time
+	// StorageClasses summarizes the objects of each storage class; its own
+	// summaries have no StorageClasses.
+	StorageClasses map[string]*partitionInfo
+	// NoncurrentSize, NoncurrentVersions and DeleteMarkers are only listed
+	// with listingOptions.Versions; the other fields then describe the
+	// current versions.
+	NoncurrentSize     int64
+	NoncurrentVersions int64
+	DeleteMarkers      int64
+	// Uploads, OldestUpload and UploadedBytes describe the multipart
+	// uploads in progress, only listed with listingOptions.Uploads.
+	Uploads       int64
+	OldestUpload  time.Time
+	UploadedBytes int64
+	// Truncated is set when listing stopped at one of the ceilings of
+	// listingOptions before S3 reported the last page, so the totals are
+	// lower bounds.
+	Truncated bool
+}
+
+const (
+	// defaultMaxPages bounds a single prefix listing to 100,000 keys.
+	defaultMaxPages = 100
+)
+
+// listingOptions caps the work done for a single rendered prefix.
+// A zero MaxKeys means no key ceiling.
+type listingOptions struct {
+	MaxPages int
+	MaxKeys  int64
+	// RequesterPays and ExpectedBucketOwner are sent with every call on the
+	// bucket: the former to read requester-pays buckets, the latter to fail
+	// rather than read a bucket another account has taken over.
+	RequesterPays       bool
+	ExpectedBucketOwner string
+	// Versions lists with ListObjectVersions rather than ListObjectsV2, to
+	// summarize noncurrent versions and delete markers too.
+	Versions bool
+	// Uploads also lists the multipart uploads in progress, and UploadParts
+	// their parts. UploadsOnly skips listing the objects.
+	Uploads     bool
+	UploadParts bool
+	UploadsOnly bool
+}
+
+// listings identifies the calls a partition summary is made of.
+type listings struct {
+	Versions    bool
+	Uploads     bool
+	UploadParts bool
+	UploadsOnly bool
+}
+
+func (options listingOptions) listings() listings {
+	return listings{
+		Versions:    options.Versions,
+		Uploads:     options.Uploads,
+		UploadParts: options.UploadParts,
+		UploadsOnly: options.UploadsOnly,
+	}
+}
+
+// setListings sets the calls needed to compute metrics.
+func (options *listingOptions) setListings(metrics []metric) {
+	options.UploadsOnly = true
+	for _, m := range metrics {
+		options.Versions = options.Versions || m.Versions
+		options.Uploads = options.Uploads || m.Uploads || m.UploadParts
+		options.UploadParts = options.UploadParts || m.UploadParts
+		options.UploadsOnly = options.UploadsOnly && (m.Uploads || m.UploadParts)
+	}
+}
+
+func (options listingOptions) requestPayer() types.RequestPayer {
+	if options.RequesterPays {
+		return types.RequestPayerRequester
+	}
+	return ""
+}
+
+// requestPayerHeader agrees to pay for calls whose input has no RequestPayer
+// field in this SDK version, by setting the header itself.
+func (options listingOptions) requestPayerHeader() []func(*s3.Options) {
+	if !options.RequesterPays {
+		return nil
+	}
+	return []func(*s3.Options){func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, smithyhttp.SetHeaderValue("x-amz-request-payer", string(types.RequestPayerRequester)))
+	}}
+}
+
+func (options listingOptions) expectedBucketOwner() *string {
+	if options.ExpectedBucketOwner == "" {
+		return nil
+	}
+	return aws.String(options.ExpectedBucketOwner)
+}
+
+func getPartitionInfo(ctx context.Context, client s3.ListObjectsV2APIClient, bucket string, prefix string, options listingOptions) (*partitionInfo, error) {
+	var info partitionInfo
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket:              aws.String(bucket),
+		Prefix:              aws.String(prefix),
+		RequestPayer:        options.requestPayer(),
+		ExpectedBucketOwner: options.expectedBucketOwner(),
+	}, func(o *s3.ListObjectsV2PaginatorOptions) {
+		o.StopOnDuplicateToken = true
+	})
+
+	pages := 0
+	for paginator.HasMorePages() {
+		if (options.MaxPages > 0 && pages >= options.MaxPages) || (options.MaxKeys > 0 && info.NumberOfKeys >= options.MaxKeys) {
+			info.Truncated = true
+			break
+		}
+
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.DefaultLogger.Error("getPartitionInfo called", "err", err)
+			return nil, err
+		}
+		pages++
+
+		// The page size is fixed, so a key ceiling within a page cuts it.
+		contents := output.Contents
+		if options.MaxKeys > 0 && info.NumberOfKeys+int64(len(contents)) > options.MaxKeys {
+			contents = contents[:options.MaxKeys-info.NumberOfKeys]
+			info.Truncated = true
+		}
+		for _, object := range contents {
+			info.observe(object)
+		}
+		if info.Truncated {
+			break
+		}
+	}
+
+	return &info, nil
+}
+
+// listPartition lists prefix with the call options asks for.
+func listPartition(ctx context.Context, client S3APIClient, bucket string, prefix string, options listingOptions) (*partitionInfo, error) {
+	info := &partitionInfo{}
+	var err error
+	switch {
+	case options.UploadsOnly:
+	case options.Versions:
+		info, err = getVersionsInfo(ctx, client, bucket, prefix, options)
+	default:
+		info, err = getPartitionInfo(ctx, client, bucket, prefix, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if options.Uploads {
+		if err := addUploadsInfo(ctx, client, bucket, prefix, options, info); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// defaultConcurrency is the number of prefixes listed in parallel when the
+// datasource JSON does not set concurrency.
+const defaultConcurrency = 8
+
+// listPartitions lists every prefix with a bounded pool of workers and returns
+// the results in the same order as prefixes. Failures and cancellation are
+// reported as by forEachPrefix, with a nil result for every prefix that was
+// not listed.
+func listPartitions(parent context.Context, client S3APIClient, bucket string, prefixes []string, options listingOptions, concurrency int) ([]*partitionInfo, []error, error) {
+	results := make([]*partitionInfo, len(prefixes))
+	errs, err := forEachPrefix(parent, len(prefixes), concurrency, func(ctx context.Context, i int) error {
+		info, err := listPartition(ctx, client, bucket, prefixes[i], options)
+		if err != nil {
+			return err
+		}
+		results[i] = info
+		return nil
+	})
+	return results, errs, err
+}
+
+// forEachPrefix runs work for the indices of n prefixes with a bounded pool of
+// workers. A failing prefix does not stop the others: its error is reported
+// at its index of the returned errors. A failure that affects the whole
+// bucket (see bucketWideError) cancels the remaining work instead and is
+// reported for every prefix whose work did not complete.
+//
+// Cancellation of parent is returned as the last error, once the work in
+// flight has stopped, so that callers can use what completed.
+func forEachPrefix(parent context.Context, n int, concurrency int, work func(ctx context.Context, i int) error) ([]error, error) {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	if concurrency > n {
+		concurrency = n
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	done := make([]bool, n)
+	errs := make([]error, n)
+	jobs := make(chan int)
+	bucketErr := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := work(ctx, i); err != nil {
+					errs[i] = err
+					if bucketWideError(err) {
+						select {
+						case bucketErr <- err:
+						default:
+						}
+						cancel()
+					}
+					continue
+				}
+				done[i] = true
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Once ctx is done, the failures of in-flight work only echo it.
+	if err := parent.Err(); err != nil {
+		for i := range errs {
+			if errors.Is(errs[i], err) {
+				errs[i] = nil
+			}
+		}
+		return errs, err
+	}
+	select {
+	case err := <-bucketErr:
+		for i := range errs {
+			if !done[i] && (errs[i] == nil || errors.Is(errs[i], context.Canceled)) {
+				errs[i] = err
+			}
+		}
+	default:
+	}
+	return errs, nil
+}
+
+// bucketWideError tells whether err would fail the listing of any prefix of
+// the bucket, so that listing the other prefixes is pointless.
+func bucketWideError(err error) bool {
+	switch classifyS3Error(err) {
+	case errorKindCredentials, errorKindUnreachable, errorKindRegionMismatch, errorKindNoSuchBucket, errorKindRequesterPays:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,302 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// metric is a value computed from the listing of a partition.
+type metric struct {
+	ID string
+	// Name is the display name of the field and Unit its Grafana unit.
+	Name string
+	Unit string
+	// Aggregation combines the partitions of an interval unless the query
+	// sets one.
+	Aggregation string
+	// Value computes the metric of a partition whose logical time, rendered
+	// from the prefix template, is t. For merged partitions, t is the time of
+	// the first one.
+	Value func(info *partitionInfo, t time.Time) float64
+	// Versions, Uploads and UploadParts are set on metrics that need
+	// partitions listed with ListObjectVersions, ListMultipartUploads and
+	// ListParts respectively.
+	Versions    bool
+	Uploads     bool
+	UploadParts bool
+}
+
+// Metric IDs used in the query JSON.
+const (
+	metricSize        = "size"
+	metricKeys        = "keys"
+	metricAverageSize = "avg_size"
+	metricMinSize     = "min_size"
+	metricMaxSize     = "max_size"
+	metricP50Size     = "p50_size"
+	metricP95Size     = "p95_size"
+	metricNewest      = "newest_modified"
+	metricOldest      = "oldest_modified"
+	metricLatency     = "arrival_latency"
+
+	metricNoncurrentSize     = "noncurrent_size"
+	metricNoncurrentVersions = "noncurrent_versions"
+	metricDeleteMarkers      = "delete_markers"
+
+	metricUploads         = "uploads"
+	metricOldestUploadAge = "oldest_upload_age"
+	metricUploadedBytes   = "uploaded_bytes"
+)
+
+// metrics is the registry of the metrics a query can ask for, by ID. Adding a
+// metric only takes an entry here, plus whatever it needs in partitionInfo.
+var metrics = map[string]metric{
+	metricSize: {
+		ID:          metricSize,
+		Name:        "Size",
+		Unit:        "bytes",
+		Aggregation: aggregationSum,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return float64(info.Size)
+		},
+	},
+	metricKeys: {
+		ID:          metricKeys,
+		Name:        "Number of keys",
+		Unit:        "short",
+		Aggregation: aggregationSum,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return float64(info.NumberOfKeys)
+		},
+	},
+	metricAverageSize: {
+		ID:          metricAverageSize,
+		Name:        "Average object size",
+		Unit:        "bytes",
+		Aggregation: aggregationMerge,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return info.averageSize()
+		},
+	},
+	metricMinSize: {
+		ID:          metricMinSize,
+		Name:        "Minimum object size",
+		Unit:        "bytes",
+		Aggregation: aggregationMerge,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			if info.NumberOfKeys == 0 {
+				return math.NaN()
+			}
+			return float64(info.MinSize)
+		},
+	},
+	metricMaxSize: {
+		ID:          metricMaxSize,
+		Name:        "Maximum object size",
+		Unit:        "bytes",
+		Aggregation: aggregationMerge,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			if info.NumberOfKeys == 0 {
+				return math.NaN()
+			}
+			return float64(info.MaxSize)
+		},
+	},
+	metricP50Size: {
+		ID:          metricP50Size,
+		Name:        "Median object size",
+		Unit:        "bytes",
+		Aggregation: aggregationMerge,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return info.sizePercentile(0.5)
+		},
+	},
+	metricP95Size: {
+		ID:          metricP95Size,
+		Name:        "95th percentile object size",
+		Unit:        "bytes",
+		Aggregation: aggregationMerge,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return info.sizePercentile(0.95)
+		},
+	},
+	metricNewest: {
+		ID:          metricNewest,
+		Name:        "Newest object",
+		Unit:        "dateTimeAsIso",
+		Aggregation: aggregationMerge,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return epochMillis(info.Newest)
+		},
+	},
+	metricOldest: {
+		ID:          metricOldest,
+		Name:        "Oldest object",
+		Unit:        "dateTimeAsIso",
+		Aggregation: aggregationMerge,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return epochMillis(info.Oldest)
+		},
+	},
+	// The latency of an interval defaults to the largest of its partitions,
+	// rather than to the newest object of the interval minus its start.
+	metricLatency: {
+		ID:          metricLatency,
+		Name:        "Arrival latency",
+		Unit:        "s",
+		Aggregation: aggregationMax,
+		Value: func(info *partitionInfo, t time.Time) float64 {
+			if info.Newest.IsZero() {
+				return math.NaN()
+			}
+			return info.Newest.Sub(t).Seconds()
+		},
+	},
+	metricNoncurrentSize: {
+		ID:          metricNoncurrentSize,
+		Name:        "Noncurrent size",
+		Unit:        "bytes",
+		Aggregation: aggregationSum,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return float64(info.NoncurrentSize)
+		},
+		Versions: true,
+	},
+	metricNoncurrentVersions: {
+		ID:          metricNoncurrentVersions,
+		Name:        "Noncurrent versions",
+		Unit:        "short",
+		Aggregation: aggregationSum,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return float64(info.NoncurrentVersions)
+		},
+		Versions: true,
+	},
+	metricDeleteMarkers: {
+		ID:          metricDeleteMarkers,
+		Name:        "Delete markers",
+		Unit:        "short",
+		Aggregation: aggregationSum,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return float64(info.DeleteMarkers)
+		},
+		Versions: true,
+	},
+	metricUploads: {
+		ID:          metricUploads,
+		Name:        "Multipart uploads",
+		Unit:        "short",
+		Aggregation: aggregationSum,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return float64(info.Uploads)
+		},
+		Uploads: true,
+	},
+	metricOldestUploadAge: {
+		ID:          metricOldestUploadAge,
+		Name:        "Oldest upload age",
+		Unit:        "s",
+		Aggregation: aggregationMax,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			if info.OldestUpload.IsZero() {
+				return 0
+			}
+			return time.Since(info.OldestUpload).Seconds()
+		},
+		Uploads: true,
+	},
+	metricUploadedBytes: {
+		ID:          metricUploadedBytes,
+		Name:        "Uploaded bytes",
+		Unit:        "bytes",
+		Aggregation: aggregationSum,
+		Value: func(info *partitionInfo, _ time.Time) float64 {
+			return float64(info.UploadedBytes)
+		},
+		UploadParts: true,
+	},
+}
+
+// epochMillis returns t in milliseconds since the epoch, as Grafana's time
+// units expect, or NaN for the zero time so that Grafana shows no value
+// rather than 1970.
+func epochMillis(t time.Time) float64 {
+	if t.IsZero() {
+		return math.NaN()
+	}
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
+
+// legacyMetric maps the integer metric of older queries, where 0 meant size
+// and anything else the number of keys, to metric IDs.
+func legacyMetric(n int) string {
+	if n == 0 {
+		return metricSize
+	}
+	return metricKeys
+}
+
+// metricID is the metric of a query. It reads both metric IDs and the integers
+// of older queries.
+type metricID string
+
+func (id *metricID) UnmarshalJSON(b []byte) error {
+	var n int
+	if err := json.Unmarshal(b, &n); err == nil {
+		*id = metricID(legacyMetric(n))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("metric must be a metric ID or a number: %s", b)
+	}
+	// Numbers quoted by older frontends are integers too.
+	if n, err := strconv.Atoi(s); err == nil {
+		*id = metricID(legacyMetric(n))
+		return nil
+	}
+	*id = metricID(s)
+	return nil
+}
+
+// lookupMetric returns the metric with the given ID; an empty ID is size.
+func lookupMetric(id metricID) (metric, error) {
+	if id == "" {
+		id = metricSize
+	}
+	m, ok := metrics[string(id)]
+	if !ok {
+		ids := make([]string, 0, len(metrics))
+		for known := range metrics {
+			ids = append(ids, known)
+		}
+		sort.Strings(ids)
+		return metric{}, fmt.Errorf("unknown metric %q, expected one of %v", id, ids)
+	}
+	return m, nil
+}
+
+// lookupMetrics returns the metrics of a query: ids when set, the single
+// metric of older queries otherwise. Repeated IDs are listed once.
+func lookupMetrics(single metricID, ids []metricID) ([]metric, error) {
+	if len(ids) == 0 {
+		ids = []metricID{single}
+	}
+	var found []metric
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		m, err := lookupMetric(id)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[m.ID] {
+			seen[m.ID] = true
+			found = append(found, m)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,378 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// A prefix template segment holding glob syntax (*, ?, [...] or {a,b})
+// stands for every segment of the bucket it matches at its level. A
+// "key=pattern" segment, e.g. "client=*" or "region=eu-*", matches the
+// key=value segments of Hive partitioned tables by value.
+const globChars = "*?[{"
+
+// globSegment is a glob segment of a rendered prefix.
+type globSegment struct {
+	// Label is the label of the matched values: the key of a "key=pattern"
+	// segment, else "match" followed by the position of the segment among
+	// the glob segments of the prefix, from 1.
+	Label string
+	// Key is the key of a "key=pattern" segment, empty otherwise.
+	Key string
+	// Patterns are the alternatives of the pattern, with braces expanded,
+	// in path.Match syntax.
+	Patterns []string
+}
+
+// parseGlobSegment returns the glob of segment, the position-th glob
+// segment of its prefix, if it has one.
+func parseGlobSegment(segment string, position int) (globSegment, bool) {
+	if !strings.ContainsAny(segment, globChars) {
+		return globSegment{}, false
+	}
+	glob := globSegment{Label: "match" + strconv.Itoa(position)}
+	pattern := segment
+	if i := strings.Index(segment, "="); i > 0 && !strings.ContainsAny(segment[:i], globChars) {
+		glob.Key = segment[:i]
+		glob.Label = glob.Key
+		pattern = segment[i+1:]
+	}
+	for _, alternative := range expandBraces(pattern) {
+		glob.Patterns = append(glob.Patterns, strings.Replace(alternative, "[!", "[^", -1))
+	}
+	return glob, true
+}
+
+// expandBraces expands the {a,b} alternations of pattern, which may be
+// nested, e.g. "{eu,us}-{1,2}" into "eu-1", "eu-2", "us-1" and "us-2". An
+// unbalanced brace is kept as is.
+func expandBraces(pattern string) []string {
+	open := strings.Index(pattern, "{")
+	if open < 0 {
+		return []string{pattern}
+	}
+	depth := 0
+	start := open + 1
+	var alternatives []string
+	for i := open; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				alternatives = append(alternatives, pattern[start:i])
+				start = i + 1
+			}
+		case '}':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			alternatives = append(alternatives, pattern[start:i])
+			var expanded []string
+			for _, alternative := range alternatives {
+				expanded = append(expanded, expandBraces(pattern[:open]+alternative+pattern[i+1:])...)
+			}
+			return expanded
+		}
+	}
+	return []string{pattern}
+}
+
+// literal tells whether the patterns have no wildcards left, so that the
+// matching segments are the patterns themselves.
+func (glob globSegment) literal() bool {
+	for _, pattern := range glob.Patterns {
+		if strings.ContainsAny(pattern, "*?[") {
+			return false
+		}
+	}
+	return true
+}
+
+// segment returns the segment of the bucket made of value.
+func (glob globSegment) segment(value string) string {
+	if glob.Key == "" {
+		return value
+	}
+	return glob.Key + "=" + value
+}
+
+// match returns the value of segment matched by the glob.
+func (glob globSegment) match(segment string) (string, bool) {
+	value := segment
+	if glob.Key != "" {
+		value = strings.TrimPrefix(segment, glob.Key+"=")
+		if value == segment {
+			return "", false
+		}
+	}
+	for _, pattern := range glob.Patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// globSegments returns the glob segments of a prefix template.
+func globSegments(template string) []globSegment {
+	var globs []globSegment
+	for _, segment := range strings.Split(template, "/") {
+		if glob, ok := parseGlobSegment(segment, len(globs)+1); ok {
+			globs = append(globs, glob)
+		}
+	}
+	return globs
+}
+
+// globLabels returns the labels of the glob segments of a prefix template.
+func globLabels(template string) []string {
+	var labels []string
+	for _, glob := range globSegments(template) {
+		labels = append(labels, glob.Label)
+	}
+	return labels
+}
+
+// validateGlobs checks the patterns of a prefix template and that every
+// groupBy key labels one of its glob segments.
+func validateGlobs(template string, groupBy []string) error {
+	labels := make(map[string]bool)
+	for _, glob := range globSegments(template) {
+		for _, pattern := range glob.Patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid glob %q in the prefix: %w", pattern, err)
+			}
+		}
+		labels[glob.Label] = true
+	}
+	for _, key := range groupBy {
+		if !labels[key] {
+			return fmt.Errorf("cannot group by %q: the prefix has no %s=* segment", key, key)
+		}
+	}
+	return nil
+}
+
+// defaultMaxMatches bounds the prefixes a rendered prefix with globs expands
+// to, when the query does not set maxMatches.
+const defaultMaxMatches = 100
+
+// fanOutError is returned when a rendered prefix matches more prefixes than
+// allowed.
+type fanOutError struct {
+	Prefix     string
+	MaxMatches int
+}
+
+func (e *fanOutError) Error() string {
+	return fmt.Sprintf("prefix %q matches more than %d prefixes; narrow its globs or raise maxMatches", e.Prefix, e.MaxMatches)
+}
+
+// partition is a prefix listed for the partition time at TimeIndex. Labels
+// holds the values matched by the glob segments of the prefix template.
+type partition struct {
+	TimeIndex int
+	Prefix    string
+	Labels    data.Labels
+}
+
+// prefixDiscovery is the outcome of the discovery of a rendered prefix: its
+// partitions, and the parents whose listing stopped at options.MaxPages.
+type prefixDiscovery struct {
+	Partitions []partition
+	Truncated  []string
+}
+
+// segmentsListing is the delimiter listing of a parent, shared by the
+// rendered prefixes discovered concurrently; done is closed once it is set.
+type segmentsListing struct {
+	done      chan struct{}
+	segments  []string
+	truncated bool
+	err       error
+}
+
+// prefixDiscoverer expands the glob segments of rendered prefixes with
+// delimiter listing, one level at a time. The segments found under a parent
+// are listed once per query, even by concurrent discoveries.
+type prefixDiscoverer struct {
+	client     s3.ListObjectsV2APIClient
+	bucket     string
+	options    listingOptions
+	maxMatches int
+	mu         sync.Mutex
+	segments   map[string]*segmentsListing
+}
+
+func newPrefixDiscoverer(client s3.ListObjectsV2APIClient, bucket string, options listingOptions, maxMatches int) *prefixDiscoverer {
+	if maxMatches <= 0 {
+		maxMatches = defaultMaxMatches
+	}
+	return &prefixDiscoverer{
+		client:     client,
+		bucket:     bucket,
+		options:    options,
+		maxMatches: maxMatches,
+		segments:   make(map[string]*segmentsListing),
+	}
+}
+
+// discover returns the partitions of prefix: itself if it has no glob
+// segments, or one per matching prefix of the bucket. It fails with a
+// *fanOutError past maxMatches prefixes.
+func (d *prefixDiscoverer) discover(ctx context.Context, timeIndex int, prefix string) (*prefixDiscovery, error) {
+	discovery := &prefixDiscovery{}
+	err := d.expand(ctx, discovery, timeIndex, prefix, "", strings.Split(prefix, "/"), 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return discovery, nil
+}
+
+func (d *prefixDiscoverer) expand(ctx context.Context, discovery *prefixDiscovery, timeIndex int, prefix string, parent string, segments []string, globs int, labels data.Labels) error {
+	if len(segments) == 0 {
+		if len(discovery.Partitions) >= d.maxMatches {
+			return &fanOutError{Prefix: prefix, MaxMatches: d.maxMatches}
+		}
+		discovery.Partitions = append(discovery.Partitions, partition{TimeIndex: timeIndex, Prefix: parent, Labels: labels})
+		return nil
+	}
+	separator := ""
+	if len(segments) > 1 {
+		separator = "/"
+	}
+
+	glob, ok := parseGlobSegment(segments[0], globs+1)
+	if !ok {
+		return d.expand(ctx, discovery, timeIndex, prefix, parent+segments[0]+separator, segments[1:], globs, labels)
+	}
+
+	// A glob matches whole segments: every match keeps its "/", so that a
+	// trailing client=* or client={1000,10000} does not list client=1000
+	// into client=10000.
+	separator = "/"
+	found := []string{}
+	if glob.literal() {
+		for _, pattern := range glob.Patterns {
+			found = append(found, glob.segment(pattern))
+		}
+	} else {
+		listing := d.childSegments(ctx, parent)
+		if listing.err != nil {
+			return listing.err
+		}
+		if listing.truncated {
+			discovery.Truncated = append(discovery.Truncated, parent)
+		}
+		found = listing.segments
+	}
+	for _, segment := range found {
+		value, ok := glob.match(segment)
+		if !ok {
+			continue
+		}
+		childLabels := data.Labels{glob.Label: value}
+		for k, v := range labels {
+			childLabels[k] = v
+		}
+		if err := d.expand(ctx, discovery, timeIndex, prefix, parent+segment+separator, segments[1:], globs+1, childLabels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// childSegments returns the listing of the names of the "directories" right
+// under parent, listing it unless another discovery already does.
+func (d *prefixDiscoverer) childSegments(ctx context.Context, parent string) *segmentsListing {
+	d.mu.Lock()
+	listing, ok := d.segments[parent]
+	if !ok {
+		listing = &segmentsListing{done: make(chan struct{})}
+		d.segments[parent] = listing
+	}
+	d.mu.Unlock()
+
+	if ok {
+		select {
+		case <-listing.done:
+			return listing
+		case <-ctx.Done():
+			return &segmentsListing{err: ctx.Err()}
+		}
+	}
+	defer close(listing.done)
+	listing.segments, listing.truncated, listing.err = d.listSegments(ctx, parent)
+	return listing
+}
+
+// listSegments lists the segments right under parent from the CommonPrefixes
+// of a delimiter listing, and whether it stopped at options.MaxPages.
+func (d *prefixDiscoverer) listSegments(ctx context.Context, parent string) ([]string, bool, error) {
+	paginator := s3.NewListObjectsV2Paginator(d.client, &s3.ListObjectsV2Input{
+		Bucket:              aws.String(d.bucket),
+		Prefix:              aws.String(parent),
+		Delimiter:           aws.String("/"),
+		RequestPayer:        d.options.requestPayer(),
+		ExpectedBucketOwner: d.options.expectedBucketOwner(),
+	}, func(o *s3.ListObjectsV2PaginatorOptions) {
+		o.StopOnDuplicateToken = true
+	})
+
+	segments := []string{}
+	for pages := 0; paginator.HasMorePages(); pages++ {
+		if d.options.MaxPages > 0 && pages >= d.options.MaxPages {
+			log.DefaultLogger.Warn("partition discovery stopped at the page ceiling", "prefix", parent, "pages", pages)
+			return segments, true, nil
+		}
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.DefaultLogger.Error("childSegments called", "err", err)
+			return nil, false, err
+		}
+		for _, commonPrefix := range output.CommonPrefixes {
+			segment := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(commonPrefix.Prefix), parent), "/")
+			segments = append(segments, segment)
+		}
+	}
+	return segments, false, nil
+}
+
+// discoverPartitions discovers the partitions of every rendered prefix with a
+// bounded pool of workers and returns them in the same order as prefixes.
+// Prefixes without glob segments are not listed. Failures and cancellation
+// are reported as by forEachPrefix, with a nil discovery for every prefix
+// that was not discovered, except that a *fanOutError fails the whole
+// discovery.
+func discoverPartitions(ctx context.Context, client s3.ListObjectsV2APIClient, bucket string, prefixes []string, options listingOptions, maxMatches int, concurrency int) ([]*prefixDiscovery, []error, error) {
+	discoverer := newPrefixDiscoverer(client, bucket, options, maxMatches)
+	discoveries := make([]*prefixDiscovery, len(prefixes))
+	errs, err := forEachPrefix(ctx, len(prefixes), concurrency, func(ctx context.Context, i int) error {
+		discovery, err := discoverer.discover(ctx, i, prefixes[i])
+		if err != nil {
+			return err
+		}
+		discoveries[i] = discovery
+		return nil
+	})
+	for _, discoverErr := range errs {
+		var fanOutErr *fanOutError
+		if errors.As(discoverErr, &fanOutErr) {
+			return nil, nil, discoverErr
+		}
+	}
+	return discoveries, errs, err
+}
@@ -3,7 +3,10 @@ package plugin
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -13,8 +16,8 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
 // Make sure SampleDatasource implements required interfaces. This is important to do
@@ -33,12 +36,6 @@ var (
 	_ instancemgmt.InstanceDisposer = (*SampleDatasource)(nil)
 )
 
-type dataSourceConfig struct {
-	AuthenticationProvider int    `json:"authenticationProvider"`
-	AccessKeyId            string `json:"accessKeyId"`
-	Endpoint               string `json:"endpoint"`
-}
-
 // NewSampleDatasource creates a new datasource instance.
 func NewSampleDatasource(settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
 	var awsConfig aws.Config
@@ -49,23 +46,39 @@ func NewSampleDatasource(settings backend.DataSourceInstanceSettings) (instancem
 	err := json.Unmarshal(settings.JSONData, &dsConfig)
 	if err != nil {
 		log.DefaultLogger.Warn("error marshalling", "err", err)
-		return nil, err
+		return nil, &ConfigError{Field: "jsonData", Reason: "cannot be parsed", Err: err}
 	}
 	log.DefaultLogger.Info("Configurations", "authenticationProvider", dsConfig.AuthenticationProvider, "endpoint", dsConfig.Endpoint)
 
-	credentialsProviderFunc = getCredentialsProviderFunc(dsConfig, settings.DecryptedSecureJSONData)
+	err = dsConfig.validate(settings.DecryptedSecureJSONData)
+	if err != nil {
+		log.DefaultLogger.Error("NewSampleDatasource called", "err", err)
+		return nil, err
+	}
 
-	if len(dsConfig.Endpoint) > 0 {
-		customResolver := aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
-			return aws.Endpoint{
-				URL:               dsConfig.Endpoint,
-				HostnameImmutable: true,
-			}, nil
-		})
+	endpointResolverFunc = dsConfig.endpointResolverFunc()
+
+	regionFunc := DummyLoadOptionsFunc()
+	if dsConfig.DefaultRegion != "" {
+		regionFunc = config.WithRegion(dsConfig.DefaultRegion)
+	}
 
-		endpointResolverFunc = config.WithEndpointResolver(customResolver)
-	} else {
-		endpointResolverFunc = DummyLoadOptionsFunc()
+	httpClientFunc, err := dsConfig.httpClientFunc(settings.DecryptedSecureJSONData)
+	if err != nil {
+		log.DefaultLogger.Error("NewSampleDatasource called", "err", err)
+		return nil, err
+	}
+
+	retryerFunc := dsConfig.retryerFunc()
+
+	credentialsProviderFunc, err = getCredentialsProviderFunc(context.TODO(), dsConfig, settings.DecryptedSecureJSONData, endpointResolverFunc, regionFunc, httpClientFunc, retryerFunc)
+	if err != nil {
+		log.DefaultLogger.Error("NewSampleDatasource called", "err", err)
+		var configErr *ConfigError
+		if errors.As(err, &configErr) {
+			return nil, configErr
+		}
+		return nil, &ConfigError{Field: "authenticationProvider", Reason: "failed to load base credentials", Err: err}
 	}
 
 	// Load the Shared AWS Configuration (~/.aws/config)
@@ -73,42 +86,122 @@ func NewSampleDatasource(settings backend.DataSourceInstanceSettings) (instancem
 		context.TODO(),
 		endpointResolverFunc,
 		credentialsProviderFunc,
+		regionFunc,
+		httpClientFunc,
+		retryerFunc,
 	)
 	if err != nil {
 		log.DefaultLogger.Error("NewSampleDatasource called", "err", err)
+		return nil, &ConfigError{Reason: "failed to load AWS configuration", Err: err}
 	}
 
 	log.DefaultLogger.Info("Create an Amazon S3 service client")
 	// Create an Amazon S3 service client
-	var client s3.ListObjectsV2APIClient = s3.NewFromConfig(awsConfig)
+	usePathStyle := dsConfig.usePathStyle()
+	var client S3APIClient = s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.UsePathStyle = usePathStyle
+	})
 	log.DefaultLogger.Info("Amazon S3 service client created successfully")
 
-	return &SampleDatasource{
+	ds := &SampleDatasource{
 		Client: &client,
-	}, nil
+		region: awsConfig.Region,
+		newRegionClient: func(region string) S3APIClient {
+			return s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+				o.Region = region
+				o.UsePathStyle = usePathStyle
+			})
+		},
+		concurrency:         dsConfig.Concurrency,
+		defaultBucket:       dsConfig.DefaultBucket,
+		requesterPays:       dsConfig.RequesterPays,
+		expectedBucketOwner: dsConfig.ExpectedBucketOwner,
+		openPartitionTTL:    defaultOpenPartitionTTL,
+		closedPartitionTTL:  defaultClosedPartitionTTL,
+	}
+	if dsConfig.AuthenticationProvider == authProviderKeys {
+		ds.credentialsExpiry, _ = dsConfig.sessionTokenExpiry()
+	}
+	if dsConfig.reportsIdentity() {
+		ds.identityClient = sts.NewFromConfig(awsConfig)
+	}
+	if dsConfig.OpenPartitionCacheTTL > 0 {
+		ds.openPartitionTTL = time.Duration(dsConfig.OpenPartitionCacheTTL) * time.Second
+	}
+	if dsConfig.ClosedPartitionCacheTTL > 0 {
+		ds.closedPartitionTTL = time.Duration(dsConfig.ClosedPartitionCacheTTL) * time.Second
+	}
+	if dsConfig.CacheMaxEntries == 0 {
+		ds.cache = newPartitionCache(defaultCacheMaxEntries)
+	} else if dsConfig.CacheMaxEntries > 0 {
+		ds.cache = newPartitionCache(dsConfig.CacheMaxEntries)
+	}
+
+	return ds, nil
 }
 
-func getCredentialsProviderFunc(dsConfig dataSourceConfig, secureData map[string]string) config.LoadOptionsFunc {
-	if dsConfig.AuthenticationProvider == 1 {
-		secretAccessKey, hasSecretAccessKey := secureData["secretAccessKey"]
-		if hasSecretAccessKey {
-			log.DefaultLogger.Info("Adding secretAccessKey for access key", "AccessKeyID", dsConfig.AccessKeyId)
-		}
-		return config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(dsConfig.AccessKeyId, secretAccessKey, ""))
+// NewDatasourceInstance is the instance factory registered with the plugin SDK. It
+// wraps NewSampleDatasource so that a *ConfigError is explained by CheckHealth on the
+// datasource configuration page and returned by every query, instead of failing the
+// plugin call with an error Grafana does not show.
+func NewDatasourceInstance(settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+	instance, err := NewSampleDatasource(settings)
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		return &SampleDatasource{configErr: configErr}, nil
 	}
-	return DummyLoadOptionsFunc()
+	return instance, err
 }
 
-func DummyLoadOptionsFunc() config.LoadOptionsFunc {
-	return func(o *config.LoadOptions) error {
-		return nil
-	}
+// S3APIClient is the set of S3 calls queries are built on. *s3.Client
+// implements it; the calls of the health check and region discovery are
+// optional and detected at run time.
+type S3APIClient interface {
+	s3.ListObjectsV2APIClient
+	s3ListObjectVersionsAPIClient
+	s3UploadsAPIClient
 }
 
 // SampleDatasource is an example datasource which can respond to data queries, reports
 // its health and has streaming skills.
 type SampleDatasource struct {
-	Client *s3.ListObjectsV2APIClient
+	Client *S3APIClient
+
+	// configErr is set when the settings could not produce a client.
+	configErr *ConfigError
+
+	// region is the region of Client. Queries against buckets in other
+	// regions use clients created by newRegionClient, kept in regionClients.
+	region          string
+	newRegionClient func(region string) S3APIClient
+	clientsMu       sync.Mutex
+	regionClients   map[string]S3APIClient
+	bucketRegions   map[string]string
+	// regionLookupFailures holds when to retry the region discovery of
+	// buckets whose lookup failed.
+	regionLookupFailures map[string]time.Time
+
+	// concurrency bounds the number of prefixes listed in parallel per query.
+	concurrency int
+
+	// defaultBucket is the bucket CheckHealth verifies access to, if any.
+	defaultBucket string
+
+	// requesterPays and expectedBucketOwner are the defaults of the query
+	// options of the same name, also used by CheckHealth.
+	requesterPays       bool
+	expectedBucketOwner string
+
+	// identityClient, if set, reports the effective identity in CheckHealth.
+	identityClient stsIdentityAPIClient
+
+	// credentialsExpiry is when temporary static credentials expire, if known.
+	credentialsExpiry time.Time
+
+	// cache holds partition listings across queries; nil disables caching.
+	cache              *partitionCache
+	openPartitionTTL   time.Duration
+	closedPartitionTTL time.Duration
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
@@ -116,6 +209,44 @@ type SampleDatasource struct {
 // be disposed and a new one will be created using NewSampleDatasource factory function.
 func (d *SampleDatasource) Dispose() {
 	// Clean up datasource instance resources.
+	d.cache.purge()
+}
+
+// listCachedPartitions returns the listing of every prefix, serving closed and
+// recently listed partitions from the cache and listing the rest concurrently.
+// partitionTimes holds the start of each prefix's partition. Like
+// listPartitions, it returns the error of every prefix that failed and what was
+// listed before ctx was done, with nil for every prefix that was not.
+func (d *SampleDatasource) listCachedPartitions(ctx context.Context, client S3APIClient, bucket string, prefixes []string, partitionTimes []time.Time, granularity time.Duration, options listingOptions) ([]*partitionInfo, []error, error) {
+	infos := make([]*partitionInfo, len(prefixes))
+	errs := make([]error, len(prefixes))
+	missing := []int{}
+	missingPrefixes := []string{}
+	for i, prefix := range prefixes {
+		if info, ok := d.cache.get(newPartitionCacheKey(bucket, prefix, options)); ok {
+			infos[i] = info
+			continue
+		}
+		missing = append(missing, i)
+		missingPrefixes = append(missingPrefixes, prefix)
+	}
+	if len(missing) == 0 {
+		return infos, errs, nil
+	}
+
+	listed, listErrs, err := listPartitions(ctx, client, bucket, missingPrefixes, options, d.concurrency)
+
+	now := time.Now()
+	for j, i := range missing {
+		infos[i] = listed[j]
+		errs[i] = listErrs[j]
+		// A truncated listing depends on the query's ceilings, so it is not shared.
+		if listed[j] != nil && !listed[j].Truncated {
+			ttl := partitionTTL(partitionTimes[i], granularity, now, d.openPartitionTTL, d.closedPartitionTTL)
+			d.cache.add(newPartitionCacheKey(bucket, prefixes[i], options), listed[j], ttl)
+		}
+	}
+	return infos, errs, err
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -130,6 +261,10 @@ func (d *SampleDatasource) QueryData(ctx context.Context, req *backend.QueryData
 
 	// loop over queries and execute them individually.
 	for _, q := range req.Queries {
+		if d.configErr != nil {
+			response.Responses[q.RefID] = backend.DataResponse{Error: d.configErr}
+			continue
+		}
 		res := d.query(ctx, req.PluginContext, q)
 
 		// save the response in a hashmap
@@ -140,113 +275,250 @@ func (d *SampleDatasource) QueryData(ctx context.Context, req *backend.QueryData
 	return response, nil
 }
 
-type partitionInfo struct {
-	Size         int64
-	NumberOfKeys int64
+type queryModel struct {
+	Endpoint      string   `json:"endpoint"`
+	Bucket        string   `json:"bucket"`
+	Prefix        string   `json:"prefix"`
+	Region        string   `json:"region"`
+	Metric        metricID `json:"metric"`
+	WithStreaming bool     `json:"withStreaming"`
+	MaxPages      int      `json:"maxPages"`
+	MaxKeys       int64    `json:"maxKeys"`
+	// Metrics, when set, replaces Metric to compute several metrics from a
+	// single listing, returned as fields of one frame.
+	Metrics []metricID `json:"metrics"`
+	// AggregateBy groups partitions into raw, hour, day, week or month
+	// intervals (default day) and Aggregation combines the partitions of
+	// an interval with sum, avg, min, max or last (default: the metric's).
+	AggregateBy string `json:"aggregateBy"`
+	Aggregation string `json:"aggregation"`
+	// RequesterPays and ExpectedBucketOwner default to the datasource
+	// settings of the same name.
+	RequesterPays       bool   `json:"requesterPays"`
+	ExpectedBucketOwner string `json:"expectedBucketOwner"`
+	// Timeout bounds the listing of the query, in seconds. When it expires,
+	// the partitions listed so far are returned with a notice.
+	Timeout int `json:"timeout"`
+	// ByStorageClass splits the metrics into one series per storage class.
+	ByStorageClass bool `json:"byStorageClass"`
+	// GroupBy splits the metrics into one series per value of these glob
+	// labels (see globSegment); the partitions of the others are merged.
+	// SplitMatches groups by every glob label.
+	GroupBy      []string `json:"groupBy"`
+	SplitMatches bool     `json:"splitMatches"`
+	// MaxMatches bounds the prefixes a rendered prefix with globs expands to.
+	MaxMatches int `json:"maxMatches"`
 }
 
-func getPartitionInfo(client s3.ListObjectsV2APIClient, bucket string, prefix string) (*partitionInfo, error) {
-	// TODO: pagination support, currently limited to 1,000 keys per call
-	var info partitionInfo
-	output, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
-	})
-	if err != nil {
-		log.DefaultLogger.Error("getPartitionSize called", "err", err)
-		return nil, err
-	}
-
-	for _, object := range output.Contents {
-		info.Size += object.Size
-		info.NumberOfKeys += 1
+// aggregation returns the aggregation of m: the query's, if set, or the
+// metric's default.
+func (qm queryModel) aggregation(m metric) string {
+	if qm.Aggregation != "" {
+		return qm.Aggregation
 	}
-
-	return &info, nil
+	return m.Aggregation
 }
 
-type queryModel struct {
-	Endpoint      string `json:"endpoint"`
-	Bucket        string `json:"bucket"`
-	Prefix        string `json:"prefix"`
-	Metric        int    `json:"metric"`
-	WithStreaming bool   `json:"withStreaming"`
-}
-
-type aggrData struct {
-	Timestamp    time.Time
-	Day          int
-	Month        time.Month
-	Year         int
-	Size         int64
-	NumberOfKeys int64
+func (qm queryModel) listingOptions() listingOptions {
+	options := listingOptions{
+		MaxPages:            qm.MaxPages,
+		MaxKeys:             qm.MaxKeys,
+		RequesterPays:       qm.RequesterPays,
+		ExpectedBucketOwner: qm.ExpectedBucketOwner,
+	}
+	if options.MaxPages <= 0 {
+		options.MaxPages = defaultMaxPages
+	}
+	return options
 }
 
-func (d *SampleDatasource) query(_ context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
+func (d *SampleDatasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
 	response := backend.DataResponse{}
 
 	// Unmarshal the JSON into our queryModel.
 	var qm queryModel
 
-	response.Error = json.Unmarshal(query.JSON, &qm)
-	if response.Error != nil {
+	if err := json.Unmarshal(query.JSON, &qm); err != nil {
+		response.Error = &queryError{Source: errorSourceUser, Err: err}
 		return response
 	}
 
 	// create data frame response.
 	frame := data.NewFrame("response")
 
-	current := query.TimeRange.From
-	// numOfFields := int(query.TimeRange.To.Sub(query.TimeRange.From).Hours() / 24)
-	times := []time.Time{}
-	values := []int64{}
+	queryMetrics, err := lookupMetrics(qm.Metric, qm.Metrics)
+	if err != nil {
+		response.Error = &queryError{Source: errorSourceUser, Err: err}
+		return response
+	}
 
-	granularity := parseGranularityInMinutes(qm.Prefix)
+	if qm.AggregateBy == "" {
+		qm.AggregateBy = intervalDay
+	}
+	for _, m := range queryMetrics {
+		if err := validateAggregation(qm.AggregateBy, qm.aggregation(m)); err != nil {
+			response.Error = &queryError{Source: errorSourceUser, Err: err}
+			return response
+		}
+	}
+	if err := validateGlobs(qm.Prefix, qm.GroupBy); err != nil {
+		response.Error = &queryError{Source: errorSourceUser, Err: err}
+		return response
+	}
+	if !qm.RequesterPays {
+		qm.RequesterPays = d.requesterPays
+	}
+	if qm.ExpectedBucketOwner == "" {
+		qm.ExpectedBucketOwner = d.expectedBucketOwner
+	}
 
-	var currentDate aggrData
-	currentDate.Timestamp = current
-	currentDate.Day = current.Day()
-	currentDate.Month = current.Month()
-	currentDate.Year = current.Year()
-	currentDate.Size = 0
-	currentDate.NumberOfKeys = 0
+	current := query.TimeRange.From
+	granularity := parseGranularityInMinutes(qm.Prefix)
 
+	// Render every prefix in the time range up front so they can be listed concurrently.
+	partitionTimes := []time.Time{}
+	prefixes := []string{}
 	for query.TimeRange.To.After(current) {
-		parsedPrefix := parsePrefix(qm.Prefix, current)
-		info, err := getPartitionInfo(*d.Client, qm.Bucket, parsedPrefix)
-		if err != nil {
-			log.DefaultLogger.Error("query called", "err", err)
-			response.Error = err
-			return response
+		partitionTimes = append(partitionTimes, current)
+		prefixes = append(prefixes, parsePrefix(qm.Prefix, current))
+		current = current.Add(time.Duration(granularity) * time.Minute)
+	}
+
+	if qm.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(qm.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	options := qm.listingOptions()
+	options.setListings(queryMetrics)
+	client := d.clientForQuery(ctx, qm)
+	discoveries, discoveryErrs, discoveryErr := discoverPartitions(ctx, client, qm.Bucket, prefixes, options, qm.MaxMatches, d.concurrency)
+	if discoveryErr != nil && !errors.Is(discoveryErr, context.DeadlineExceeded) {
+		log.DefaultLogger.Error("query called", "err", discoveryErr)
+		source := errorSourceDownstream
+		var fanOutErr *fanOutError
+		if errors.As(discoveryErr, &fanOutErr) {
+			source = errorSourceUser
 		}
+		response.Error = &queryError{Source: source, Err: discoveryErr}
+		return response
+	}
 
-		if current.Day() == currentDate.Day && current.Month() == currentDate.Month && current.Year() == currentDate.Year {
-			currentDate.Size += info.Size
-			currentDate.NumberOfKeys += info.NumberOfKeys
-		} else {
-			times = append(times, currentDate.Timestamp)
-			if qm.Metric == 0 {
-				values = append(values, currentDate.Size)
-			} else {
-				values = append(values, currentDate.NumberOfKeys)
+	// Times with a failed prefix, and past the deadline with an undiscovered
+	// or unlisted one, are left out; only the fully listed times are charted.
+	var truncated []string
+	var failures []prefixFailure
+	var partitions []partition
+	discovered := 0
+	truncatedParents := make(map[string]bool)
+	complete := make([]bool, len(partitionTimes))
+	for i, discovery := range discoveries {
+		if discoveryErrs[i] != nil {
+			failures = append(failures, prefixFailure{Prefix: prefixes[i], Kind: classifyS3Error(discoveryErrs[i]), Err: discoveryErrs[i]})
+		}
+		if discovery == nil {
+			continue
+		}
+		discovered++
+		complete[i] = true
+		partitions = append(partitions, discovery.Partitions...)
+		for _, parent := range discovery.Truncated {
+			if !truncatedParents[parent] {
+				truncatedParents[parent] = true
+				truncated = append(truncated, parent)
 			}
-			currentDate.Timestamp = current
-			currentDate.Day = current.Day()
-			currentDate.Month = current.Month()
-			currentDate.Year = current.Year()
-			currentDate.Size = info.Size
-			currentDate.NumberOfKeys = info.NumberOfKeys
 		}
+	}
+	partitionPrefixes := make([]string, len(partitions))
+	prefixTimes := make([]time.Time, len(partitions))
+	for j, part := range partitions {
+		partitionPrefixes[j] = part.Prefix
+		prefixTimes[j] = partitionTimes[part.TimeIndex]
+	}
 
-		current = current.Add(time.Duration(granularity) * time.Minute)
+	infos, errs, err := d.listCachedPartitions(ctx, client, qm.Bucket, partitionPrefixes, prefixTimes, time.Duration(granularity)*time.Minute, options)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		log.DefaultLogger.Error("query called", "err", err)
+		response.Error = &queryError{Source: errorSourceDownstream, Err: err}
+		return response
 	}
-	// TODO: add last currentDate
 
-	// add fields.
-	frame.Fields = append(frame.Fields,
-		data.NewField("time", nil, times),
-		data.NewField("values", nil, values),
-	)
+	if err == nil {
+		err = discoveryErr
+	}
+	listedPrefixes := 0
+	for j, info := range infos {
+		if errs[j] != nil {
+			failures = append(failures, prefixFailure{Prefix: partitionPrefixes[j], Kind: classifyS3Error(errs[j]), Err: errs[j]})
+		}
+		if info == nil {
+			complete[partitions[j].TimeIndex] = false
+			continue
+		}
+		listedPrefixes++
+		if info.Truncated {
+			truncated = append(truncated, partitionPrefixes[j])
+		}
+	}
+	var listed []int
+	var listedTimes []time.Time
+	for i, ok := range complete {
+		if ok {
+			listed = append(listed, i)
+			listedTimes = append(listedTimes, partitionTimes[i])
+		}
+	}
+	if len(listedTimes) == 0 && (err != nil || len(failures) > 0) {
+		if err == nil {
+			err = failures[0].Err
+		}
+		log.DefaultLogger.Error("query called", "err", err)
+		response.Error = &queryError{Source: errorSourceDownstream, Err: err}
+		return response
+	}
+	groupBy := qm.GroupBy
+	if qm.SplitMatches {
+		groupBy = globLabels(qm.Prefix)
+	}
+	querySeries := groupSeries(partitions, infos, listed, groupBy)
+	if qm.ByStorageClass {
+		querySeries = splitByStorageClass(querySeries)
+	}
+
+	// add fields: the time, then one per series and metric. Every metric is
+	// aggregated over the same partitions, so the times are shared.
+	times, _ := groupByInterval(listedTimes, qm.AggregateBy)
+	var valueFields []*data.Field
+	for _, s := range querySeries {
+		for _, m := range queryMetrics {
+			_, values := aggregateMetric(listedTimes, s.Infos, m, qm.AggregateBy, qm.aggregation(m))
+			field := data.NewField(m.ID, s.Labels, values)
+			field.Config = &data.FieldConfig{
+				DisplayNameFromDS: displayName(m, s.Labels, len(queryMetrics) == 1),
+				Unit:              m.Unit,
+			}
+			valueFields = append(valueFields, field)
+		}
+	}
+	frame.Fields = append(frame.Fields, data.NewField("time", nil, times))
+	frame.Fields = append(frame.Fields, valueFields...)
+
+	if len(truncated) > 0 {
+		frame.AppendNotices(truncatedNotice(truncated, options))
+	}
+	if len(failures) > 0 {
+		log.DefaultLogger.Warn("query failed for some prefixes, returning partial results", "failed", len(failures), "prefixes", len(partitions))
+		frame.AppendNotices(failureNotices(failures)...)
+		setFailedPrefixes(frame, failures)
+	}
+	if discoveryErr != nil {
+		log.DefaultLogger.Warn("partition discovery timed out, returning partial results", "discovered", discovered, "prefixes", len(prefixes))
+		frame.AppendNotices(discoveryTimeoutNotice(discovered, len(prefixes)))
+	} else if err != nil {
+		log.DefaultLogger.Warn("query timed out, returning partial results", "listed", listedPrefixes, "prefixes", len(partitions))
+		frame.AppendNotices(timeoutNotice(listedPrefixes, len(partitions)))
+	}
 
 	// add the frames to the response.
 	response.Frames = append(response.Frames, frame)
@@ -254,6 +526,85 @@ func (d *SampleDatasource) query(_ context.Context, pCtx backend.PluginContext,
 	return response
 }
 
+func truncatedNotice(prefixes []string, options listingOptions) data.Notice {
+	ceiling := fmt.Sprintf("%d pages", options.MaxPages)
+	if options.MaxKeys > 0 {
+		ceiling = fmt.Sprintf("%s or %d keys", ceiling, options.MaxKeys)
+	}
+	return data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text: fmt.Sprintf("Listing stopped after %s for %d prefix(es), starting with %q; values are lower bounds. Raise maxPages/maxKeys to list them fully.",
+			ceiling, len(prefixes), prefixes[0]),
+	}
+}
+
+// prefixFailure is a rendered prefix whose listing failed.
+type prefixFailure struct {
+	Prefix string
+	Kind   s3ErrorKind
+	Err    error
+}
+
+// failureNotices returns one warning per kind of failure, in order of first
+// occurrence, so that a bucket-wide problem does not flood the panel.
+func failureNotices(failures []prefixFailure) []data.Notice {
+	var kinds []s3ErrorKind
+	byKind := make(map[s3ErrorKind][]prefixFailure)
+	for _, failure := range failures {
+		if _, ok := byKind[failure.Kind]; !ok {
+			kinds = append(kinds, failure.Kind)
+		}
+		byKind[failure.Kind] = append(byKind[failure.Kind], failure)
+	}
+
+	notices := make([]data.Notice, 0, len(kinds))
+	for _, kind := range kinds {
+		first := byKind[kind][0]
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text: fmt.Sprintf("Listing failed (%s) for %d prefix(es), starting with %q; their partitions are missing: %s",
+				kind, len(byKind[kind]), first.Prefix, first.Err),
+		})
+	}
+	return notices
+}
+
+// setFailedPrefixes records every failed prefix in the custom frame metadata,
+// for inspection in the query inspector.
+func setFailedPrefixes(frame *data.Frame, failures []prefixFailure) {
+	failed := make([]map[string]string, len(failures))
+	for i, failure := range failures {
+		failed[i] = map[string]string{
+			"prefix":    failure.Prefix,
+			"errorKind": string(failure.Kind),
+			"error":     failure.Err.Error(),
+		}
+	}
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.Custom = map[string]interface{}{
+		"errorSource":    errorSourceDownstream,
+		"failedPrefixes": failed,
+	}
+}
+
+func timeoutNotice(listed int, total int) data.Notice {
+	return data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text: fmt.Sprintf("Query timed out after listing %d of %d prefixes; the remaining partitions are missing. Raise the query timeout or narrow the time range.",
+			listed, total),
+	}
+}
+
+func discoveryTimeoutNotice(discovered int, total int) data.Notice {
+	return data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text: fmt.Sprintf("Query timed out after discovering the partitions of %d of %d prefixes; the remaining partitions are missing. Raise the query timeout or narrow the globs or the time range.",
+			discovered, total),
+	}
+}
+
 func parseGranularityInMinutes(input string) int {
 	minGranularity := 60 * 24 // Day in minutes
 	var oddIndex int = 1
@@ -335,14 +686,51 @@ func parseTime(date time.Time, format string) string {
 // The main use case for these health checks is the test button on the
 // datasource configuration page which allows users to verify that
 // a datasource is working as expected.
-func (d *SampleDatasource) CheckHealth(_ context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+func (d *SampleDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	log.DefaultLogger.Info("CheckHealth called", "request", req)
 
-	var status = backend.HealthStatusOk
-	var message = "Data source is working"
+	if d.configErr != nil {
+		return configErrorHealthResult(d.configErr), nil
+	}
+	if d.Client == nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: "S3 client is not configured",
+		}, nil
+	}
+	client, ok := (*d.Client).(s3HealthAPIClient)
+	if !ok {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusUnknown,
+			Message: "S3 client does not support health checks",
+		}, nil
+	}
+
+	expiryWarning, err := staticCredentialsExpiry(d.credentialsExpiry, time.Now())
+	if err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: fmt.Sprintf("Invalid credentials: %s", err),
+		}, nil
+	}
+
+	message, err := checkS3Access(ctx, client, d.defaultBucket, listingOptions{
+		RequesterPays:       d.requesterPays,
+		ExpectedBucketOwner: d.expectedBucketOwner,
+	})
+	if err != nil {
+		log.DefaultLogger.Error("CheckHealth called", "err", err)
+		return healthCheckFailure(err, d.defaultBucket), nil
+	}
+	if identity := callerIdentity(ctx, d.identityClient); identity != "" {
+		message = fmt.Sprintf("%s as %s", message, identity)
+	}
+	if expiryWarning != "" {
+		message = fmt.Sprintf("%s; %s", message, expiryWarning)
+	}
 
 	return &backend.CheckHealthResult{
-		Status:  status,
+		Status:  backend.HealthStatusOk,
 		Message: message,
 	}, nil
 }
@@ -381,7 +769,7 @@ func (d *SampleDatasource) RunStream(ctx context.Context, req *backend.RunStream
 	// Add fields (matching the same schema used in QueryData).
 	frame.Fields = append(frame.Fields,
 		data.NewField("time", nil, make([]time.Time, 1)),
-		data.NewField("values", nil, make([]int64, 1)),
+		data.NewField("values", nil, make([]float64, 1)),
 	)
 
 	counter := 0
@@ -395,7 +783,7 @@ func (d *SampleDatasource) RunStream(ctx context.Context, req *backend.RunStream
 		case <-time.After(time.Second):
 			// Send new data periodically.
 			frame.Fields[0].Set(0, time.Now())
-			frame.Fields[1].Set(0, int64(10*(counter%2+1)))
+			frame.Fields[1].Set(0, float64(10*(counter%2+1)))
 
 			counter++
 
@@ -2,13 +2,46 @@ package plugin
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
 var parseTimeTests = []struct {
@@ -99,6 +132,28 @@ func TestParsePrefix(t *testing.T) {
 	}
 }
 
+// UnmockedS3Client fails the calls of S3APIClient other than ListObjectsV2,
+// for the mocks of queries that only list objects.
+type UnmockedS3Client struct{}
+
+func (UnmockedS3Client) ListObjectVersions(context.Context, *s3.ListObjectVersionsInput, ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	return nil, errors.New("ListObjectVersions is not mocked")
+}
+
+func (UnmockedS3Client) ListMultipartUploads(context.Context, *s3.ListMultipartUploadsInput, ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	return nil, errors.New("ListMultipartUploads is not mocked")
+}
+
+func (UnmockedS3Client) ListParts(context.Context, *s3.ListPartsInput, ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	return nil, errors.New("ListParts is not mocked")
+}
+
+// ObjectsOnlyS3Client adapts a mock of ListObjectsV2 to S3APIClient.
+type ObjectsOnlyS3Client struct {
+	s3.ListObjectsV2APIClient
+	UnmockedS3Client
+}
+
 type MockS3Client struct {
 	error bool
 }
@@ -117,19 +172,2309 @@ func (client* MockS3Client) ListObjectsV2(context.Context, *s3.ListObjectsV2Inpu
 	}, nil
 }
 
+func (client *MockS3Client) ListObjectVersions(ctx context.Context, input *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	return UnmockedS3Client{}.ListObjectVersions(ctx, input, optFns...)
+}
+
+func (client *MockS3Client) ListMultipartUploads(ctx context.Context, input *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	return UnmockedS3Client{}.ListMultipartUploads(ctx, input, optFns...)
+}
+
+func (client *MockS3Client) ListParts(ctx context.Context, input *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	return UnmockedS3Client{}.ListParts(ctx, input, optFns...)
+}
+
 func TestGetPartitionInfoWithError(t *testing.T) {
-	_, err := getPartitionInfo(&MockS3Client{true}, "", "")
+	_, err := getPartitionInfo(context.Background(), &MockS3Client{true}, "", "", listingOptions{})
 	if err.Error() != "mocked failure" {
 		t.Errorf("%s", err)
 	}
 }
 
 func TestGetPartitionInfo(t *testing.T) {
-	info, err := getPartitionInfo(&MockS3Client{false}, "", "")
+	info, err := getPartitionInfo(context.Background(), &MockS3Client{false}, "", "", listingOptions{})
 	if err != nil {
 		t.Errorf("nil error expected")
 	}
 	if info == nil {
 		t.Errorf("expected info, got nil")
 	}
-}
\ No newline at end of file
+}
+
+// PagedS3Client serves numberOfKeys objects of objectSize bytes, pageSize keys
+// per page, following the continuation token like S3 does.
+type PagedS3Client struct {
+	UnmockedS3Client
+	numberOfKeys int
+	pageSize     int
+	objectSize   int64
+	calls        int64
+}
+
+func (client *PagedS3Client) ListObjectsV2(_ context.Context, input *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	atomic.AddInt64(&client.calls, 1)
+	start := 0
+	if input.ContinuationToken != nil {
+		var err error
+		start, err = strconv.Atoi(*input.ContinuationToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+	end := start + client.pageSize
+	if end > client.numberOfKeys {
+		end = client.numberOfKeys
+	}
+
+	output := &s3.ListObjectsV2Output{}
+	for i := start; i < end; i++ {
+		key := strconv.Itoa(i)
+		output.Contents = append(output.Contents, types.Object{Key: &key, Size: client.objectSize})
+	}
+	if end < client.numberOfKeys {
+		token := strconv.Itoa(end)
+		output.IsTruncated = true
+		output.NextContinuationToken = &token
+	}
+	return output, nil
+}
+
+var getPartitionInfoPagingTests = []struct {
+	numberOfKeys int            // keys under the prefix
+	options      listingOptions // listing options
+	keys         int64          // expected number of keys
+	calls        int64          // expected ListObjectsV2 calls
+	truncated    bool           // expected truncation flag
+}{
+	{0, listingOptions{MaxPages: 10}, 0, 1, false},
+	{999, listingOptions{MaxPages: 10}, 999, 1, false},
+	{1000, listingOptions{MaxPages: 10}, 1000, 1, false},
+	{1001, listingOptions{MaxPages: 10}, 1001, 2, false},
+	{20000, listingOptions{MaxPages: 20}, 20000, 20, false},
+	{20001, listingOptions{MaxPages: 20}, 20000, 20, true},
+	{5500, listingOptions{MaxPages: 10, MaxKeys: 3000}, 3000, 3, true},
+	{3000, listingOptions{MaxPages: 10, MaxKeys: 3000}, 3000, 3, false},
+	{3000, listingOptions{MaxPages: 10, MaxKeys: 2500}, 2500, 3, true},
+	{2500, listingOptions{MaxPages: 10, MaxKeys: 2500}, 2500, 3, false},
+}
+
+func TestGetPartitionInfoPaging(t *testing.T) {
+	for _, testCase := range getPartitionInfoPagingTests {
+		client := &PagedS3Client{numberOfKeys: testCase.numberOfKeys, pageSize: 1000, objectSize: 10}
+		info, err := getPartitionInfo(context.Background(), client, "bucket", "prefix", testCase.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.NumberOfKeys != testCase.keys || info.Size != testCase.keys*10 {
+			t.Errorf("getPartitionInfo(%d keys, %+v): expected %d keys and %d bytes, actual %d keys and %d bytes",
+				testCase.numberOfKeys, testCase.options, testCase.keys, testCase.keys*10, info.NumberOfKeys, info.Size)
+		}
+		if client.calls != testCase.calls {
+			t.Errorf("getPartitionInfo(%d keys, %+v): expected %d calls, actual %d", testCase.numberOfKeys, testCase.options, testCase.calls, client.calls)
+		}
+		if info.Truncated != testCase.truncated {
+			t.Errorf("getPartitionInfo(%d keys, %+v): expected truncated %t", testCase.numberOfKeys, testCase.options, testCase.truncated)
+		}
+	}
+}
+
+func TestQueryReportsTruncatedListing(t *testing.T) {
+	var client S3APIClient = &PagedS3Client{numberOfKeys: 2500, pageSize: 1000, objectSize: 1}
+	ds := SampleDatasource{Client: &client}
+	response := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 2, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 2, 12, 0, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"bucket": "bucket", "prefix": "<yyyy-MM-dd>", "maxPages": 2}`),
+	})
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	meta := response.Frames[0].Meta
+	if meta == nil || len(meta.Notices) != 1 || meta.Notices[0].Severity != data.NoticeSeverityWarning {
+		t.Fatalf("expected a single truncation warning, got %+v", meta)
+	}
+}
+
+// PrefixS3Client answers every listing with a single object whose size is the
+// numeric suffix of the prefix, optionally failing the failing prefix with err
+// and waiting for the context to finish on blocked prefixes.
+type PrefixS3Client struct {
+	UnmockedS3Client
+	failing  string
+	err      error
+	blocked  string
+	inFlight int64
+	maxSeen  int64
+}
+
+func (client *PrefixS3Client) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	n := atomic.AddInt64(&client.inFlight, 1)
+	defer atomic.AddInt64(&client.inFlight, -1)
+	for {
+		seen := atomic.LoadInt64(&client.maxSeen)
+		if n <= seen || atomic.CompareAndSwapInt64(&client.maxSeen, seen, n) {
+			break
+		}
+	}
+
+	prefix := *input.Prefix
+	if prefix == client.failing {
+		if client.err != nil {
+			return nil, client.err
+		}
+		return nil, errors.New("mocked failure")
+	}
+	if prefix == client.blocked {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	time.Sleep(time.Millisecond)
+
+	size, err := strconv.ParseInt(prefix[strings.LastIndex(prefix, "=")+1:], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.ListObjectsV2Output{Contents: []types.Object{{Size: size}}}, nil
+}
+
+func TestListPartitionsKeepsOrder(t *testing.T) {
+	prefixes := []string{}
+	for i := 0; i < 50; i++ {
+		prefixes = append(prefixes, "hour="+strconv.Itoa(i))
+	}
+	client := &PrefixS3Client{}
+	infos, _, err := listPartitions(context.Background(), client, "bucket", prefixes, listingOptions{MaxPages: 1}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, info := range infos {
+		if info.Size != int64(i) {
+			t.Errorf("listPartitions: expected size %d at index %d, actual %d", i, i, info.Size)
+		}
+	}
+	if client.maxSeen > 4 {
+		t.Errorf("listPartitions: expected at most 4 concurrent listings, actual %d", client.maxSeen)
+	}
+}
+
+func TestListPartitionsIsolatesErrors(t *testing.T) {
+	client := &PrefixS3Client{failing: "hour=1"}
+	infos, errs, err := listPartitions(context.Background(), client, "bucket", []string{"hour=0", "hour=1", "hour=2", "hour=3"}, listingOptions{MaxPages: 1}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range infos {
+		failed := i == 1
+		if (infos[i] == nil) != failed || (errs[i] != nil) != failed {
+			t.Errorf("listPartitions: expected prefix %d to fail %t, actual %v %v", i, failed, infos[i], errs[i])
+		}
+	}
+	if errs[1].Error() != "mocked failure" {
+		t.Errorf("listPartitions: expected mocked failure, actual %v", errs[1])
+	}
+}
+
+func TestListPartitionsStopsOnBucketWideError(t *testing.T) {
+	noSuchBucket := responseError(404, "NoSuchBucket", nil)
+	client := &PrefixS3Client{failing: "hour=1", err: noSuchBucket, blocked: "hour=2"}
+	infos, errs, err := listPartitions(context.Background(), client, "bucket", []string{"hour=0", "hour=1", "hour=2", "hour=3"}, listingOptions{MaxPages: 1}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(infos); i++ {
+		if infos[i] != nil || errs[i] != noSuchBucket {
+			t.Errorf("listPartitions: expected prefix %d to fail with the bucket error, actual %v %v", i, infos[i], errs[i])
+		}
+	}
+}
+
+func TestQueryIsolatesFailedPrefixes(t *testing.T) {
+	var client S3APIClient = &PrefixS3Client{failing: "hour=01", err: responseError(403, "AccessDenied", nil)}
+	ds := SampleDatasource{Client: &client}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 25, 4, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "hour=<HH>", "aggregateBy": "raw"}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	frame := response.Frames[0]
+	if frame.Fields[1].Len() != 3 {
+		t.Errorf("expected the three listed partitions, actual %d", frame.Fields[1].Len())
+	}
+	if len(frame.Meta.Notices) != 1 || !strings.HasPrefix(frame.Meta.Notices[0].Text, "Listing failed (access_denied) for 1 prefix(es), starting with \"hour=01\"") {
+		t.Errorf("expected an access denied notice, actual %+v", frame.Meta.Notices)
+	}
+	custom, _ := json.Marshal(frame.Meta.Custom)
+	if !strings.Contains(string(custom), `"failedPrefixes":[{"error":`) || !strings.Contains(string(custom), `"errorKind":"access_denied","prefix":"hour=01"`) {
+		t.Errorf("expected the failed prefix in the metadata, actual %s", custom)
+	}
+}
+
+var queryErrorTests = []struct {
+	json   string          // query JSON
+	client *PrefixS3Client // S3 client
+	source errorSource     // expected error source
+}{
+	{`{"prefix": "hour=<HH>", "aggregation": "median"}`, &PrefixS3Client{}, errorSourceUser},
+	{`{"prefix": 1}`, &PrefixS3Client{}, errorSourceUser},
+	{`{"prefix": "hour=<HH>", "metric": "files"}`, &PrefixS3Client{}, errorSourceUser},
+	{`{"prefix": "hour=<HH>", "metrics": ["size", "files"]}`, &PrefixS3Client{}, errorSourceUser},
+	{`{"prefix": "hour=<HH>", "groupBy": ["client"]}`, &PrefixS3Client{}, errorSourceUser},
+	{`{"prefix": "hour=<HH>"}`, &PrefixS3Client{failing: "hour=00", err: responseError(404, "NoSuchBucket", nil)}, errorSourceDownstream},
+}
+
+func TestQueryErrorSource(t *testing.T) {
+	for _, testCase := range queryErrorTests {
+		var client S3APIClient = testCase.client
+		// A single prefix, so that a failure cannot race with partial results.
+		ds := SampleDatasource{Client: &client}
+		query := backend.DataQuery{
+			TimeRange: backend.TimeRange{
+				From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+				To:   time.Date(2021, 9, 25, 1, 0, 0, 0, time.UTC),
+			},
+			JSON: []byte(testCase.json),
+		}
+		response := ds.query(context.Background(), backend.PluginContext{}, query)
+		var queryErr *queryError
+		if !errors.As(response.Error, &queryErr) || queryErr.Source != testCase.source {
+			t.Errorf("query(%s): expected a %s error, actual %v", testCase.json, testCase.source, response.Error)
+		}
+	}
+}
+
+func TestListPartitionsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &PrefixS3Client{blocked: "hour=0"}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, _, err := listPartitions(ctx, client, "bucket", []string{"hour=0", "hour=1", "hour=2"}, listingOptions{MaxPages: 1}, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("listPartitions: expected context.Canceled, actual %v", err)
+	}
+}
+
+func TestQueryReturnsPartialResultsOnTimeout(t *testing.T) {
+	var client S3APIClient = &PrefixS3Client{blocked: "hour=02"}
+	ds := SampleDatasource{Client: &client, concurrency: 1}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 25, 4, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "hour=<HH>", "aggregateBy": "raw", "timeout": 1}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	frame := response.Frames[0]
+	if frame.Fields[1].Len() != 2 || frame.Fields[1].At(1).(float64) != 1 {
+		t.Errorf("expected the two partitions listed before the timeout, actual %d", frame.Fields[1].Len())
+	}
+	if frame.Meta == nil || len(frame.Meta.Notices) != 1 || !strings.Contains(frame.Meta.Notices[0].Text, "listing 2 of 4 prefixes") {
+		t.Errorf("expected a timeout notice, actual %+v", frame.Meta)
+	}
+}
+
+func TestQueryFailsWhenNothingListedBeforeTimeout(t *testing.T) {
+	var client S3APIClient = &PrefixS3Client{blocked: "hour=00"}
+	ds := SampleDatasource{Client: &client, concurrency: 1}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 25, 2, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "hour=<HH>", "aggregateBy": "raw"}`),
+	}
+	response := ds.query(ctx, backend.PluginContext{}, query)
+	if !errors.Is(response.Error, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, actual %v", response.Error)
+	}
+}
+
+func TestPartitionCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newPartitionCache(2)
+	a := partitionCacheKey{Bucket: "bucket", Prefix: "a"}
+	b := partitionCacheKey{Bucket: "bucket", Prefix: "b"}
+	c := partitionCacheKey{Bucket: "bucket", Prefix: "c"}
+
+	cache.add(a, &partitionInfo{Size: 1}, time.Hour)
+	cache.add(b, &partitionInfo{Size: 2}, time.Hour)
+	if _, ok := cache.get(a); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	cache.add(c, &partitionInfo{Size: 3}, time.Hour)
+
+	if _, ok := cache.get(b); ok {
+		t.Error("expected b to be evicted")
+	}
+	if info, ok := cache.get(a); !ok || info.Size != 1 {
+		t.Error("expected a to survive eviction")
+	}
+	if cache.len() != 2 {
+		t.Errorf("expected 2 entries, actual %d", cache.len())
+	}
+
+	cache.purge()
+	if cache.len() != 0 {
+		t.Errorf("expected an empty cache after purge, actual %d entries", cache.len())
+	}
+}
+
+func TestPartitionCacheExpires(t *testing.T) {
+	now := time.Date(2021, 2, 10, 0, 0, 0, 0, time.UTC)
+	cache := newPartitionCache(10)
+	cache.now = func() time.Time { return now }
+	key := partitionCacheKey{Bucket: "bucket", Prefix: "a"}
+
+	cache.add(key, &partitionInfo{Size: 1}, time.Minute)
+	now = now.Add(59 * time.Second)
+	if _, ok := cache.get(key); !ok {
+		t.Error("expected entry before its TTL")
+	}
+	now = now.Add(time.Second)
+	if _, ok := cache.get(key); ok {
+		t.Error("expected entry to expire after its TTL")
+	}
+}
+
+var partitionTTLTests = []struct {
+	start    time.Time     // partition start
+	expected time.Duration // expected TTL
+}{
+	{time.Date(2021, 2, 10, 10, 0, 0, 0, time.UTC), time.Hour},
+	{time.Date(2021, 2, 10, 11, 0, 0, 0, time.UTC), time.Hour},
+	{time.Date(2021, 2, 10, 11, 30, 0, 0, time.UTC), time.Minute},
+	{time.Date(2021, 2, 10, 12, 0, 0, 0, time.UTC), time.Minute},
+}
+
+func TestPartitionTTL(t *testing.T) {
+	now := time.Date(2021, 2, 10, 12, 0, 0, 0, time.UTC)
+	for _, testCase := range partitionTTLTests {
+		actual := partitionTTL(testCase.start, time.Hour, now, time.Minute, time.Hour)
+		if actual != testCase.expected {
+			t.Errorf("partitionTTL(%s): expected %s, actual %s", testCase.start, testCase.expected, actual)
+		}
+	}
+}
+
+func TestQueryServesClosedPartitionsFromCache(t *testing.T) {
+	mock := &PagedS3Client{numberOfKeys: 10, pageSize: 1000, objectSize: 1}
+	var client S3APIClient = mock
+	ds := SampleDatasource{
+		Client:             &client,
+		cache:              newPartitionCache(100),
+		openPartitionTTL:   time.Minute,
+		closedPartitionTTL: time.Hour,
+	}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 2, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 2, 11, 0, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"bucket": "bucket", "prefix": "<yyyy-MM-dd>/<HH>"}`),
+	}
+
+	for i := 0; i < 2; i++ {
+		response := ds.query(context.Background(), backend.PluginContext{}, query)
+		if response.Error != nil {
+			t.Fatal(response.Error)
+		}
+	}
+	if mock.calls != 24 {
+		t.Errorf("expected 24 listings across both queries, actual %d", mock.calls)
+	}
+
+	ds.Dispose()
+	if ds.cache.len() != 0 {
+		t.Errorf("expected Dispose to empty the cache, actual %d entries", ds.cache.len())
+	}
+}
+
+func TestQueryDoesNotShareCacheAcrossBucketOwners(t *testing.T) {
+	mock := &PagedS3Client{numberOfKeys: 10, pageSize: 1000, objectSize: 1}
+	var client S3APIClient = mock
+	ds := SampleDatasource{
+		Client:             &client,
+		cache:              newPartitionCache(100),
+		openPartitionTTL:   time.Minute,
+		closedPartitionTTL: time.Hour,
+	}
+	timeRange := backend.TimeRange{
+		From: time.Date(2021, 2, 10, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2021, 2, 10, 1, 0, 0, 0, time.UTC),
+	}
+
+	for _, owner := range []string{"111111111111", "222222222222", "111111111111"} {
+		query := backend.DataQuery{
+			TimeRange: timeRange,
+			JSON:      []byte(`{"bucket": "bucket", "prefix": "<yyyy-MM-dd>/<HH>", "expectedBucketOwner": "` + owner + `"}`),
+		}
+		response := ds.query(context.Background(), backend.PluginContext{}, query)
+		if response.Error != nil {
+			t.Fatal(response.Error)
+		}
+	}
+	if mock.calls != 2 {
+		t.Errorf("expected one listing per bucket owner, actual %d", mock.calls)
+	}
+}
+
+var intervalStartTests = []struct {
+	interval string    // interval input
+	expected time.Time // expected result
+}{
+	{intervalRaw, time.Date(2021, 9, 25, 17, 40, 0, 0, time.UTC)},
+	{intervalHour, time.Date(2021, 9, 25, 17, 0, 0, 0, time.UTC)},
+	{intervalDay, time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC)},
+	{intervalWeek, time.Date(2021, 9, 20, 0, 0, 0, 0, time.UTC)},
+	{intervalMonth, time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)},
+}
+
+func TestIntervalStart(t *testing.T) {
+	// A Saturday.
+	current := time.Date(2021, 9, 25, 17, 40, 0, 0, time.UTC)
+	for _, testCase := range intervalStartTests {
+		actual := intervalStart(current, testCase.interval)
+		if !actual.Equal(testCase.expected) {
+			t.Errorf("intervalStart(%s, %s): expected %s, actual %s", current, testCase.interval, testCase.expected, actual)
+		}
+	}
+}
+
+var aggregateTests = []struct {
+	interval    string    // interval input
+	aggregation string    // aggregation input
+	expected    []float64 // expected result
+}{
+	{intervalRaw, aggregationSum, []float64{1, 2, 3, 4, 5, 6}},
+	{intervalDay, aggregationSum, []float64{6, 15}},
+	{intervalDay, aggregationAvg, []float64{2, 5}},
+	{intervalDay, aggregationMin, []float64{1, 4}},
+	{intervalDay, aggregationMax, []float64{3, 6}},
+	{intervalDay, aggregationLast, []float64{3, 6}},
+	{intervalMonth, aggregationSum, []float64{21}},
+}
+
+func TestAggregate(t *testing.T) {
+	times := []time.Time{}
+	for i := 0; i < 6; i++ {
+		times = append(times, time.Date(2021, 9, 25, 12, 0, 0, 0, time.UTC).Add(time.Duration(i)*4*time.Hour))
+	}
+	values := []float64{1, 2, 3, 4, 5, 6}
+	for _, testCase := range aggregateTests {
+		actualTimes, actual := aggregate(times, values, testCase.interval, testCase.aggregation)
+		if !reflect.DeepEqual(testCase.expected, actual) {
+			t.Errorf("aggregate(%s, %s): expected %v, actual %v", testCase.interval, testCase.aggregation, testCase.expected, actual)
+		}
+		if len(actualTimes) != len(actual) || !actualTimes[0].Equal(times[0]) {
+			t.Errorf("aggregate(%s, %s): expected points to start at the first partition, actual %v", testCase.interval, testCase.aggregation, actualTimes)
+		}
+	}
+}
+
+func TestAggregateSkipsNaN(t *testing.T) {
+	times := []time.Time{
+		time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 9, 25, 12, 0, 0, 0, time.UTC),
+		time.Date(2021, 9, 26, 0, 0, 0, 0, time.UTC),
+	}
+	values := []float64{math.NaN(), 2, math.NaN()}
+	_, actual := aggregate(times, values, intervalDay, aggregationMax)
+	if len(actual) != 2 || actual[0] != 2 || !math.IsNaN(actual[1]) {
+		t.Errorf("aggregate: expected [2 NaN], actual %v", actual)
+	}
+}
+
+func TestQueryEmitsLastInterval(t *testing.T) {
+	var client S3APIClient = &MockS3Client{}
+	ds := SampleDatasource{Client: &client}
+	response := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 2, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 2, 12, 0, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "<yyyy-MM-dd>/<HH>", "aggregateBy": "day"}`),
+	})
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	values := response.Frames[0].Fields[1]
+	if values.Len() != 2 {
+		t.Fatalf("expected 2 days, actual %d", values.Len())
+	}
+	if values.At(1).(float64) != 24*1024 {
+		t.Errorf("expected the last day to sum 24 hourly partitions, actual %v", values.At(1))
+	}
+}
+
+func TestQueryWithUnknownAggregation(t *testing.T) {
+	ds := SampleDatasource{}
+	response := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		JSON: []byte(`{"prefix": "<yyyy-MM-dd>", "aggregation": "median"}`),
+	})
+	if response.Error == nil {
+		t.Error("expected an error for an unknown aggregation")
+	}
+}
+
+func responseError(statusCode int, code string, header http.Header) error {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &smithy.OperationError{
+		ServiceID:     "S3",
+		OperationName: "HeadBucket",
+		Err: &awshttp.ResponseError{
+			ResponseError: &smithyhttp.ResponseError{
+				Response: &smithyhttp.Response{Response: &http.Response{StatusCode: statusCode, Header: header}},
+				Err:      &smithy.GenericAPIError{Code: code, Message: "mocked"},
+			},
+		},
+	}
+}
+
+var classifyS3ErrorTests = []struct {
+	err      error       // error input
+	expected s3ErrorKind // expected result
+}{
+	{errors.New("mocked failure"), errorKindUnknown},
+	{&v4.SigningError{Err: errors.New("failed to retrieve credentials")}, errorKindCredentials},
+	{&smithyhttp.RequestSendError{Err: errors.New("connection refused")}, errorKindUnreachable},
+	{context.DeadlineExceeded, errorKindTimeout},
+	{&smithyhttp.RequestSendError{Err: context.DeadlineExceeded}, errorKindTimeout},
+	{fmt.Errorf("operation error S3: ListObjectsV2: %w", context.Canceled), errorKindCanceled},
+	{responseError(403, "InvalidAccessKeyId", nil), errorKindCredentials},
+	{responseError(403, "SignatureDoesNotMatch", nil), errorKindCredentials},
+	{responseError(403, "AccessDenied", nil), errorKindAccessDenied},
+	{responseError(403, "Forbidden", nil), errorKindAccessDenied},
+	{responseError(301, "MovedPermanently", nil), errorKindRegionMismatch},
+	{responseError(400, "AuthorizationHeaderMalformed", nil), errorKindRegionMismatch},
+	{responseError(404, "NoSuchBucket", nil), errorKindNoSuchBucket},
+	{responseError(503, "SlowDown", nil), errorKindThrottled},
+	{&requesterPaysError{Bucket: "data", Err: responseError(403, "AccessDenied", nil)}, errorKindRequesterPays},
+}
+
+func TestClassifyS3Error(t *testing.T) {
+	for _, testCase := range classifyS3ErrorTests {
+		actual := classifyS3Error(testCase.err)
+		if actual != testCase.expected {
+			t.Errorf("classifyS3Error(%s): expected %s, actual %s", testCase.err, testCase.expected, actual)
+		}
+	}
+}
+
+// requestPayer returns the x-amz-request-payer header that optFns set on a
+// request.
+func requestPayer(optFns ...func(*s3.Options)) string {
+	var options s3.Options
+	for _, fn := range optFns {
+		fn(&options)
+	}
+	stack := middleware.NewStack("requestPayer", smithyhttp.NewStackRequest)
+	for _, fn := range options.APIOptions {
+		if err := fn(stack); err != nil {
+			return ""
+		}
+	}
+	var header string
+	handler := middleware.DecorateHandler(middleware.HandlerFunc(func(_ context.Context, input interface{}) (interface{}, middleware.Metadata, error) {
+		header = input.(*smithyhttp.Request).Header.Get("X-Amz-Request-Payer")
+		return nil, middleware.Metadata{}, nil
+	}), stack)
+	if _, _, err := handler.Handle(context.Background(), struct{}{}); err != nil {
+		return ""
+	}
+	return header
+}
+
+// HealthS3Client fails HeadBucket, ListBuckets and ListObjectsV2 with err, if
+// set, or ListObjectsV2 with listErr instead. HeadBucket and ListObjectsV2
+// succeed regardless on a requesterPays bucket when the request agrees to pay.
+type HealthS3Client struct {
+	MockS3Client
+	err           error
+	listErr       error
+	requesterPays bool
+	headBuckets   []string
+	mu            sync.Mutex
+	listed        []*s3.ListObjectsV2Input
+}
+
+func (client *HealthS3Client) ListObjectsV2(_ context.Context, input *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	client.mu.Lock()
+	client.listed = append(client.listed, input)
+	client.mu.Unlock()
+	if client.requesterPays && input.RequestPayer == types.RequestPayerRequester {
+		return &s3.ListObjectsV2Output{}, nil
+	}
+	if client.listErr != nil {
+		return nil, client.listErr
+	}
+	if client.err != nil {
+		return nil, client.err
+	}
+	return &s3.ListObjectsV2Output{}, nil
+}
+
+func (client *HealthS3Client) ListBuckets(context.Context, *s3.ListBucketsInput, ...func(*s3.Options)) (*s3.ListBucketsOutput, error) {
+	if client.err != nil {
+		return nil, client.err
+	}
+	return &s3.ListBucketsOutput{}, nil
+}
+
+func (client *HealthS3Client) HeadBucket(_ context.Context, input *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	client.headBuckets = append(client.headBuckets, *input.Bucket)
+	if client.err != nil && !(client.requesterPays && requestPayer(optFns...) == "requester") {
+		return nil, client.err
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func TestCheckHealth(t *testing.T) {
+	var client S3APIClient = &HealthS3Client{}
+	ds := SampleDatasource{Client: &client}
+	result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusOk {
+		t.Errorf("expected a healthy data source, actual %s", result.Message)
+	}
+}
+
+func TestCheckHealthWithDefaultBucket(t *testing.T) {
+	mock := &HealthS3Client{}
+	var client S3APIClient = mock
+	ds := SampleDatasource{Client: &client, defaultBucket: "data"}
+	result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusOk || !reflect.DeepEqual(mock.headBuckets, []string{"data"}) {
+		t.Errorf("expected HeadBucket on the default bucket, actual %v: %s", mock.headBuckets, result.Message)
+	}
+}
+
+var checkHealthFailureTests = []struct {
+	err     error  // S3 error
+	message string // expected message prefix
+}{
+	{&v4.SigningError{Err: errors.New("failed to retrieve credentials")}, "Invalid credentials"},
+	{&smithyhttp.RequestSendError{Err: errors.New("connection refused")}, "Unable to reach the S3 endpoint"},
+	{responseError(403, "Forbidden", nil), "Access denied"},
+	{responseError(301, "MovedPermanently", http.Header{"X-Amz-Bucket-Region": []string{"eu-west-1"}}), "Region mismatch"},
+	{responseError(404, "NotFound", nil), "Bucket \"data\" does not exist"},
+}
+
+func TestCheckHealthFailures(t *testing.T) {
+	for _, testCase := range checkHealthFailureTests {
+		var client S3APIClient = &HealthS3Client{err: testCase.err}
+		ds := SampleDatasource{Client: &client, defaultBucket: "data"}
+		result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != backend.HealthStatusError || !strings.HasPrefix(result.Message, testCase.message) {
+			t.Errorf("CheckHealth(%s): expected error %q, actual %s %q", testCase.err, testCase.message, result.Status, result.Message)
+		}
+		var details map[string]string
+		if err := json.Unmarshal(result.JSONDetails, &details); err != nil || details["verboseMessage"] != testCase.err.Error() {
+			t.Errorf("CheckHealth(%s): expected the underlying error in details, actual %s", testCase.err, result.JSONDetails)
+		}
+	}
+	var client S3APIClient = &HealthS3Client{err: responseError(301, "MovedPermanently", http.Header{"X-Amz-Bucket-Region": []string{"eu-west-1"}})}
+	ds := SampleDatasource{Client: &client, defaultBucket: "data"}
+	result, _ := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if !strings.HasSuffix(result.Message, "eu-west-1") {
+		t.Errorf("expected the bucket region in the message, actual %q", result.Message)
+	}
+}
+
+var checkHealthDeniedTests = []struct {
+	listErr error  // ListObjectsV2 error after a denied HeadBucket
+	message string // expected message prefix
+}{
+	{responseError(403, "InvalidAccessKeyId", nil), "Invalid credentials"},
+	{responseError(400, "AuthorizationHeaderMalformed", nil), "Region mismatch"},
+	{responseError(403, "AccessDenied", nil), "Access denied"},
+}
+
+func TestCheckHealthExplainsDeniedHeadBucket(t *testing.T) {
+	for _, testCase := range checkHealthDeniedTests {
+		var client S3APIClient = &HealthS3Client{err: responseError(403, "Forbidden", nil), listErr: testCase.listErr}
+		ds := SampleDatasource{Client: &client, defaultBucket: "data"}
+		result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != backend.HealthStatusError || !strings.HasPrefix(result.Message, testCase.message) {
+			t.Errorf("CheckHealth(%s): expected error %q, actual %s %q", testCase.listErr, testCase.message, result.Status, result.Message)
+		}
+	}
+}
+
+func TestCheckHealthWithoutBucketNotFound(t *testing.T) {
+	var client S3APIClient = &HealthS3Client{err: responseError(404, "NotFound", nil)}
+	ds := SampleDatasource{Client: &client}
+	result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusError || !strings.Contains(result.Message, "endpoint URL") {
+		t.Errorf("expected an endpoint error, actual %s %q", result.Status, result.Message)
+	}
+}
+
+func TestCheckHealthRequesterPays(t *testing.T) {
+	mock := &HealthS3Client{err: responseError(403, "AccessDenied", nil), requesterPays: true}
+	var client S3APIClient = mock
+	ds := SampleDatasource{Client: &client, defaultBucket: "data"}
+	result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusError || !strings.HasPrefix(result.Message, "Bucket \"data\" is a requester-pays bucket") {
+		t.Errorf("expected a requester pays error, actual %s %q", result.Status, result.Message)
+	}
+
+	mock = &HealthS3Client{err: responseError(403, "AccessDenied", nil), requesterPays: true}
+	client = mock
+	ds = SampleDatasource{Client: &client, defaultBucket: "data", requesterPays: true, expectedBucketOwner: "123456789012"}
+	result, err = ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusOk || len(mock.headBuckets) != 1 || len(mock.listed) != 0 {
+		t.Errorf("expected a single paid HeadBucket, actual %s %q", result.Status, result.Message)
+	}
+}
+
+func TestQueryPassesRequesterPaysAndBucketOwner(t *testing.T) {
+	mock := &HealthS3Client{}
+	var client S3APIClient = mock
+	ds := SampleDatasource{Client: &client, requesterPays: true}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 25, 2, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"bucket": "data", "prefix": "<yyyy-MM-dd>/<HH>/", "expectedBucketOwner": "123456789012"}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if len(mock.listed) == 0 {
+		t.Fatal("expected listings")
+	}
+	for _, input := range mock.listed {
+		if input.RequestPayer != types.RequestPayerRequester || aws.ToString(input.ExpectedBucketOwner) != "123456789012" {
+			t.Errorf("expected a paid listing of the expected owner's bucket, actual %q %v", input.RequestPayer, input.ExpectedBucketOwner)
+		}
+	}
+}
+
+// LocationS3Client reports location for every bucket and counts the lookups.
+type LocationS3Client struct {
+	MockS3Client
+	location string
+	lookups  int
+	err      error
+}
+
+func (client *LocationS3Client) GetBucketLocation(context.Context, *s3.GetBucketLocationInput, ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error) {
+	client.lookups++
+	if client.err != nil {
+		return nil, client.err
+	}
+	return &s3.GetBucketLocationOutput{LocationConstraint: types.BucketLocationConstraint(client.location)}, nil
+}
+
+// RegionS3Client is a client created for a specific region.
+type RegionS3Client struct {
+	MockS3Client
+	region string
+}
+
+func newRegionTestDatasource(location string) (*SampleDatasource, *LocationS3Client, *[]string) {
+	mock := &LocationS3Client{location: location}
+	var client S3APIClient = mock
+	created := []string{}
+	ds := &SampleDatasource{
+		Client: &client,
+		region: "us-west-2",
+		newRegionClient: func(region string) S3APIClient {
+			created = append(created, region)
+			return &RegionS3Client{region: region}
+		},
+	}
+	return ds, mock, &created
+}
+
+var clientForQueryTests = []struct {
+	location string // bucket location constraint
+	region   string // query region
+	expected string // expected client region, empty for the default client
+	lookups  int    // expected GetBucketLocation calls
+}{
+	{"us-west-2", "", "", 1},
+	{"eu-central-1", "", "eu-central-1", 1},
+	{"", "", "us-east-1", 1},
+	{"EU", "", "eu-west-1", 1},
+	{"eu-central-1", "ap-south-1", "ap-south-1", 0},
+	{"eu-central-1", "us-west-2", "", 0},
+}
+
+func TestClientForQuery(t *testing.T) {
+	for _, testCase := range clientForQueryTests {
+		ds, mock, created := newRegionTestDatasource(testCase.location)
+		for i := 0; i < 2; i++ {
+			client := ds.clientForQuery(context.Background(), queryModel{Bucket: "bucket", Region: testCase.region})
+			actual := ""
+			if regionClient, ok := client.(*RegionS3Client); ok {
+				actual = regionClient.region
+			}
+			if actual != testCase.expected {
+				t.Errorf("clientForQuery(%q, %q): expected client for %q, actual %q", testCase.location, testCase.region, testCase.expected, actual)
+			}
+		}
+		if mock.lookups != testCase.lookups {
+			t.Errorf("clientForQuery(%q, %q): expected %d bucket location lookups, actual %d", testCase.location, testCase.region, testCase.lookups, mock.lookups)
+		}
+		if testCase.expected != "" && len(*created) != 1 {
+			t.Errorf("clientForQuery(%q, %q): expected a single regional client, actual %v", testCase.location, testCase.region, *created)
+		}
+	}
+}
+
+func TestBucketRegionCachesFailures(t *testing.T) {
+	ds, mock, _ := newRegionTestDatasource("eu-central-1")
+	mock.err = responseError(403, "AccessDenied", nil)
+	for i := 0; i < 2; i++ {
+		if region := ds.bucketRegion(context.Background(), "bucket", listingOptions{}); region != "" {
+			t.Errorf("bucketRegion: expected the default region, actual %q", region)
+		}
+	}
+	if mock.lookups != 1 {
+		t.Errorf("expected a single lookup until the retry interval, actual %d", mock.lookups)
+	}
+
+	// Past the retry interval, the region is discovered again.
+	mock.err = nil
+	ds.regionLookupFailures["bucket"] = time.Now().Add(-time.Second)
+	if region := ds.bucketRegion(context.Background(), "bucket", listingOptions{}); region != "eu-central-1" || mock.lookups != 2 {
+		t.Errorf("bucketRegion: expected eu-central-1 from a second lookup, actual %q after %d lookups", region, mock.lookups)
+	}
+}
+
+func TestGetCredentialsProviderFuncCachesAssumedRole(t *testing.T) {
+	dsConfig := dataSourceConfig{
+		AuthenticationProvider: authProviderAssumeRole,
+		AssumeRoleArn:          "arn:aws:iam::123456789012:role/reader",
+		DefaultRegion:          "us-east-1",
+	}
+	optFn, err := getCredentialsProviderFunc(context.Background(), dsConfig, nil, config.WithRegion("us-east-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var options config.LoadOptions
+	if err := optFn(&options); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := options.Credentials.(*aws.CredentialsCache); !ok {
+		t.Errorf("expected assumed role credentials to be cached, actual %T", options.Credentials)
+	}
+}
+
+type MockSTSClient struct {
+	arn string
+	err error
+}
+
+func (client *MockSTSClient) GetCallerIdentity(context.Context, *sts.GetCallerIdentityInput, ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	if client.err != nil {
+		return nil, client.err
+	}
+	return &sts.GetCallerIdentityOutput{Arn: aws.String(client.arn)}, nil
+}
+
+func TestCheckHealthReportsIdentity(t *testing.T) {
+	var client S3APIClient = &HealthS3Client{}
+	ds := SampleDatasource{Client: &client, identityClient: &MockSTSClient{arn: "arn:aws:sts::123456789012:assumed-role/reader/grafana"}}
+	result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusOk || !strings.HasSuffix(result.Message, "as arn:aws:sts::123456789012:assumed-role/reader/grafana") {
+		t.Errorf("expected the identity in the message, actual %q", result.Message)
+	}
+
+	ds.identityClient = &MockSTSClient{err: errors.New("mocked failure")}
+	result, err = ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusOk || result.Message != "Data source is working" {
+		t.Errorf("expected identity failures to be ignored, actual %s %q", result.Status, result.Message)
+	}
+}
+
+const assumeRoleWithWebIdentityResponse = `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>web_identity_key</AccessKeyId>
+      <SecretAccessKey>web_identity_secret</SecretAccessKey>
+      <SessionToken>web_identity_token</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+  <ResponseMetadata>
+    <RequestId>request-id</RequestId>
+  </ResponseMetadata>
+</AssumeRoleWithWebIdentityResponse>`
+
+// setenv sets an environment variable for the duration of the test.
+func setenv(t *testing.T, key string, value string) {
+	previous, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// newFakeSTS serves AssumeRoleWithWebIdentity and records the form of each request.
+func newFakeSTS(t *testing.T, requests *[]url.Values) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		*requests = append(*requests, r.PostForm)
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, assumeRoleWithWebIdentityResponse)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWebIdentityCredentials(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("oidc-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	requests := []url.Values{}
+	server := newFakeSTS(t, &requests)
+
+	setenv(t, "AWS_WEB_IDENTITY_TOKEN_FILE", "/var/run/secrets/eks.amazonaws.com/serviceaccount/token")
+	setenv(t, "AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/node")
+	dsConfig := dataSourceConfig{
+		AuthenticationProvider: authProviderWebIdentity,
+		StsEndpoint:            server.URL,
+		WebIdentityTokenFile:   tokenFile,
+		WebIdentityRoleArn:     "arn:aws:iam::123456789012:role/team-a",
+	}
+	if err := dsConfig.validate(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	optFn, err := getCredentialsProviderFunc(context.Background(), dsConfig, nil, dsConfig.endpointResolverFunc(), config.WithRegion("us-east-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var options config.LoadOptions
+	if err := optFn(&options); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := options.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if creds.AccessKeyID != "web_identity_key" || creds.SessionToken != "web_identity_token" {
+		t.Errorf("expected credentials from the fake STS, actual %+v", creds)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("expected a single STS request, actual %d", len(requests))
+	}
+	if requests[0].Get("Action") != "AssumeRoleWithWebIdentity" ||
+		requests[0].Get("RoleArn") != "arn:aws:iam::123456789012:role/team-a" ||
+		requests[0].Get("WebIdentityToken") != "oidc-token" ||
+		requests[0].Get("RoleSessionName") != defaultRoleSessionName {
+		t.Errorf("expected the configured role and token, actual %v", requests[0])
+	}
+}
+
+func TestWebIdentityDefaultsToEnvironment(t *testing.T) {
+	setenv(t, "AWS_WEB_IDENTITY_TOKEN_FILE", "/token")
+	setenv(t, "AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/node")
+	tokenFile, roleArn := dataSourceConfig{}.webIdentity()
+	if tokenFile != "/token" || roleArn != "arn:aws:iam::123456789012:role/node" {
+		t.Errorf("expected the environment defaults, actual %q and %q", tokenFile, roleArn)
+	}
+}
+
+var staticCredentialsTests = []struct {
+	dsConfig   dataSourceConfig  // jsonData input
+	secureData map[string]string // secureJsonData input
+	expected   aws.Credentials   // expected credentials
+}{
+	{
+		dataSourceConfig{AccessKeyId: "legacy_key"},
+		map[string]string{"secretAccessKey": "test_secret"},
+		aws.Credentials{AccessKeyID: "legacy_key", SecretAccessKey: "test_secret", Source: credentials.StaticCredentialsName},
+	},
+	{
+		dataSourceConfig{AccessKeyId: "legacy_key"},
+		map[string]string{"accessKeyId": "secure_key", "secretAccessKey": "test_secret", "sessionToken": "test_token"},
+		aws.Credentials{AccessKeyID: "secure_key", SecretAccessKey: "test_secret", SessionToken: "test_token", Source: credentials.StaticCredentialsName},
+	},
+	{
+		dataSourceConfig{SessionTokenExpiration: "2021-02-10T12:00:00Z"},
+		map[string]string{"accessKeyId": "secure_key", "secretAccessKey": "test_secret", "sessionToken": "test_token"},
+		aws.Credentials{AccessKeyID: "secure_key", SecretAccessKey: "test_secret", SessionToken: "test_token", Source: credentials.StaticCredentialsName,
+			CanExpire: true, Expires: time.Date(2021, 2, 10, 12, 0, 0, 0, time.UTC)},
+	},
+}
+
+func TestStaticCredentials(t *testing.T) {
+	for _, testCase := range staticCredentialsTests {
+		var options config.LoadOptions
+		if err := staticCredentialsProviderFunc(testCase.dsConfig, testCase.secureData)(&options); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := options.Credentials.Retrieve(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(testCase.expected, actual) {
+			t.Errorf("staticCredentialsProviderFunc(%+v): expected %+v, actual %+v", testCase.dsConfig, testCase.expected, actual)
+		}
+	}
+}
+
+var staticCredentialsExpiryTests = []struct {
+	expires time.Time // credentials expiry
+	warning bool      // expected warning
+	expired bool      // expected error
+}{
+	{time.Time{}, false, false},
+	{time.Date(2021, 2, 12, 0, 0, 0, 0, time.UTC), false, false},
+	{time.Date(2021, 2, 10, 15, 0, 0, 0, time.UTC), true, false},
+	{time.Date(2021, 2, 10, 12, 0, 0, 0, time.UTC), false, true},
+}
+
+func TestStaticCredentialsExpiry(t *testing.T) {
+	now := time.Date(2021, 2, 10, 12, 0, 0, 0, time.UTC)
+	for _, testCase := range staticCredentialsExpiryTests {
+		warning, err := staticCredentialsExpiry(testCase.expires, now)
+		if (warning != "") != testCase.warning || (err != nil) != testCase.expired {
+			t.Errorf("staticCredentialsExpiry(%s): expected warning %t and error %t, actual %q and %v", testCase.expires, testCase.warning, testCase.expired, warning, err)
+		}
+	}
+}
+
+func TestCheckHealthWarnsBeforeCredentialsExpire(t *testing.T) {
+	var client S3APIClient = &HealthS3Client{}
+	ds := SampleDatasource{Client: &client, credentialsExpiry: time.Now().Add(2 * time.Hour)}
+	result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusOk || !strings.Contains(result.Message, "warning: temporary credentials expire in 2h0m0s") {
+		t.Errorf("expected an expiry warning, actual %s %q", result.Status, result.Message)
+	}
+
+	ds.credentialsExpiry = time.Now().Add(-time.Minute)
+	result, err = ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusError {
+		t.Errorf("expected expired credentials to fail the health check, actual %s %q", result.Status, result.Message)
+	}
+}
+
+// pemCertificate encodes a DER certificate as PEM.
+func pemCertificate(der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// newClientKeyPair generates a self-signed client certificate and its key as PEM.
+func newClientKeyPair(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "grafana"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pemCertificate(der), string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestHTTPClientTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	clientCert, clientKey := newClientKeyPair(t)
+	caCert := pemCertificate(server.Certificate().Raw)
+
+	var httpClientTLSTests = []struct {
+		dsConfig   dataSourceConfig  // TLS options
+		secureData map[string]string // secureJsonData input
+		expected   int               // expected status, 0 for a TLS error
+	}{
+		{dataSourceConfig{TLSAuthWithCACert: true}, map[string]string{"tlsCACert": caCert}, http.StatusForbidden},
+		{dataSourceConfig{TLSSkipVerify: true}, nil, http.StatusForbidden},
+		{dataSourceConfig{TLSAuth: true, TLSAuthWithCACert: true}, map[string]string{"tlsCACert": caCert, "tlsClientCert": clientCert, "tlsClientKey": clientKey}, http.StatusOK},
+		{dataSourceConfig{TLSAuth: true}, map[string]string{"tlsClientCert": clientCert, "tlsClientKey": clientKey}, 0},
+	}
+
+	for _, testCase := range httpClientTLSTests {
+		client, err := testCase.dsConfig.httpClient(testCase.secureData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		actual := 0
+		response, err := client.Do(request)
+		if err == nil {
+			actual = response.StatusCode
+			response.Body.Close()
+		}
+		if actual != testCase.expected {
+			t.Errorf("httpClient(%+v): expected status %d, actual %d (%v)", testCase.dsConfig, testCase.expected, actual, err)
+		}
+	}
+}
+
+func TestHTTPClientDefaultsToSDK(t *testing.T) {
+	client, err := dataSourceConfig{}.httpClient(nil)
+	if client != nil || err != nil {
+		t.Errorf("httpClient(): expected no client, actual %v (%v)", client, err)
+	}
+}
+
+var usePathStyleTests = []struct {
+	endpoint       string // endpoint input
+	forcePathStyle string // forcePathStyle input, "" for unset
+	expected       bool   // expected path-style addressing
+}{
+	{"", "", false},
+	{"http://localhost:9000", "", true},
+	{"", "true", true},
+	{"http://localhost:9000", "false", false},
+}
+
+func TestUsePathStyle(t *testing.T) {
+	for _, testCase := range usePathStyleTests {
+		dsConfig := dataSourceConfig{Endpoint: testCase.endpoint}
+		if testCase.forcePathStyle != "" {
+			forcePathStyle := testCase.forcePathStyle == "true"
+			dsConfig.ForcePathStyle = &forcePathStyle
+		}
+		if actual := dsConfig.usePathStyle(); actual != testCase.expected {
+			t.Errorf("usePathStyle(%q, %q): expected %t, actual %t", testCase.endpoint, testCase.forcePathStyle, testCase.expected, actual)
+		}
+	}
+}
+
+func TestNewSampleDatasourceUsesPathStyle(t *testing.T) {
+	var paths []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		fmt.Fprint(w, listBucketResult)
+	}))
+	defer server.Close()
+
+	var settings backend.DataSourceInstanceSettings
+	settings.JSONData = []byte(fmt.Sprintf(`{"authenticationProvider": 1, "endpoint": %q, "defaultRegion": "us-east-1", "tlsAuthWithCACert": true}`, server.URL))
+	settings.DecryptedSecureJSONData = map[string]string{"accessKeyId": "test_key", "secretAccessKey": "test_secret", "tlsCACert": pemCertificate(server.Certificate().Raw)}
+	instance, err := NewSampleDatasource(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := instance.(*SampleDatasource)
+	info, err := getPartitionInfo(context.Background(), *ds.Client, "test-bucket", "2021/", listingOptions{MaxPages: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 3 || !reflect.DeepEqual(paths, []string{"/test-bucket"}) {
+		t.Errorf("expected one path-style request of 3 bytes, actual %v of %d bytes", paths, info.Size)
+	}
+}
+
+// listBucketResult is a one-object ListObjectsV2 response.
+const listBucketResult = `<ListBucketResult><KeyCount>1</KeyCount><Contents><Key>a</Key><Size>3</Size></Contents></ListBucketResult>`
+
+func TestNewSampleDatasourceUsesProxy(t *testing.T) {
+	var hosts []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.URL.Host)
+		fmt.Fprint(w, listBucketResult)
+	}))
+	defer proxy.Close()
+
+	var settings backend.DataSourceInstanceSettings
+	settings.JSONData = []byte(fmt.Sprintf(`{"authenticationProvider": 1, "endpoint": "http://s3.example.test", "defaultRegion": "us-east-1", "proxyUrl": %q}`, proxy.URL))
+	settings.DecryptedSecureJSONData = map[string]string{"accessKeyId": "test_key", "secretAccessKey": "test_secret"}
+	instance, err := NewSampleDatasource(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := instance.(*SampleDatasource)
+	if _, err := getPartitionInfo(context.Background(), *ds.Client, "test-bucket", "2021/", listingOptions{MaxPages: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hosts, []string{"s3.example.test"}) {
+		t.Errorf("expected one proxied request to s3.example.test, actual %v", hosts)
+	}
+}
+
+func TestNewSampleDatasourceResponseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	var settings backend.DataSourceInstanceSettings
+	settings.JSONData = []byte(fmt.Sprintf(`{"authenticationProvider": 1, "endpoint": %q, "defaultRegion": "us-east-1", "responseTimeout": 1, "retryMode": "off"}`, server.URL))
+	settings.DecryptedSecureJSONData = map[string]string{"accessKeyId": "test_key", "secretAccessKey": "test_secret"}
+	instance, err := NewSampleDatasource(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := instance.(*SampleDatasource)
+	start := time.Now()
+	_, err = getPartitionInfo(context.Background(), *ds.Client, "test-bucket", "2021/", listingOptions{MaxPages: 1})
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("expected the listing to time out after a second, actual %v after %s", err, time.Since(start))
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("expected a single attempt with retries off, actual %d", requests)
+	}
+}
+
+var retryerTests = []struct {
+	retryMode   string // retryMode input
+	maxAttempts int    // maxAttempts input
+	expected    int    // expected max attempts, 0 for the SDK default retryer
+}{
+	{"", 0, 0},
+	{"standard", 0, 0},
+	{"", 5, 5},
+	{"standard", 1, 1},
+	{"off", 5, 1},
+}
+
+func TestRetryerFunc(t *testing.T) {
+	for _, testCase := range retryerTests {
+		var options config.LoadOptions
+		dsConfig := dataSourceConfig{RetryMode: testCase.retryMode, MaxAttempts: testCase.maxAttempts}
+		if err := dsConfig.retryerFunc()(&options); err != nil {
+			t.Fatal(err)
+		}
+		actual := 0
+		if options.Retryer != nil {
+			actual = options.Retryer().MaxAttempts()
+		}
+		if actual != testCase.expected {
+			t.Errorf("retryerFunc(%q, %d): expected %d, actual %d", testCase.retryMode, testCase.maxAttempts, testCase.expected, actual)
+		}
+	}
+}
+
+var metricIDTests = []struct {
+	json     string // metric JSON
+	expected string // expected metric ID
+}{
+	{`0`, metricSize},
+	{`1`, metricKeys},
+	{`2`, metricKeys},
+	{`"1"`, metricKeys},
+	{`"size"`, metricSize},
+	{`"keys"`, metricKeys},
+}
+
+func TestMetricIDMigratesIntegers(t *testing.T) {
+	for _, testCase := range metricIDTests {
+		var qm queryModel
+		if err := json.Unmarshal([]byte(`{"metric": `+testCase.json+`}`), &qm); err != nil {
+			t.Fatal(err)
+		}
+		m, err := lookupMetric(qm.Metric)
+		if err != nil || m.ID != testCase.expected {
+			t.Errorf("metric %s: expected %s, actual %s (%v)", testCase.json, testCase.expected, m.ID, err)
+		}
+	}
+}
+
+func TestQuerySetsMetricUnit(t *testing.T) {
+	var client S3APIClient = &PrefixS3Client{}
+	ds := SampleDatasource{Client: &client}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 25, 4, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "hour=<HH>", "metric": "keys"}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	field := response.Frames[0].Fields[1]
+	if field.Name != metricKeys || field.Config == nil || field.Config.Unit != "short" || field.Config.DisplayNameFromDS != "Number of keys" {
+		t.Errorf("expected the number of keys field, actual %s %+v", field.Name, field.Config)
+	}
+	if field.At(0).(float64) != 4 {
+		t.Errorf("expected 4 keys, actual %v", field.At(0))
+	}
+}
+
+func TestQueryReturnsMetricsInOneFrame(t *testing.T) {
+	client := &PagedS3Client{numberOfKeys: 1500, pageSize: 1000, objectSize: 10}
+	var s3Client S3APIClient = client
+	ds := SampleDatasource{Client: &s3Client}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 27, 0, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "<yyyy-MM-dd>", "metrics": ["size", "keys", "size"]}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if len(response.Frames) != 1 {
+		t.Fatalf("expected one frame, actual %d", len(response.Frames))
+	}
+	fields := response.Frames[0].Fields
+	if len(fields) != 3 || fields[1].Name != metricSize || fields[2].Name != metricKeys {
+		t.Fatalf("expected time, size and keys fields, actual %d fields", len(fields))
+	}
+	if fields[1].At(1).(float64) != 15000 || fields[2].At(1).(float64) != 1500 || fields[1].Config.Unit != "bytes" {
+		t.Errorf("expected 15000 bytes in 1500 keys per day, actual %v %s and %v", fields[1].At(1), fields[1].Config.Unit, fields[2].At(1))
+	}
+	// Two days of two pages each, listed once for both metrics.
+	if client.calls != 4 {
+		t.Errorf("expected a single listing per prefix, actual %d calls", client.calls)
+	}
+}
+
+// SizesS3Client serves, under each prefix, one object per listed size.
+type SizesS3Client map[string][]int64
+
+func (client SizesS3Client) ListObjectsV2(_ context.Context, input *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	output := &s3.ListObjectsV2Output{}
+	for i, size := range client[*input.Prefix] {
+		key := *input.Prefix + "/" + strconv.Itoa(i)
+		output.Contents = append(output.Contents, types.Object{Key: &key, Size: size})
+	}
+	return output, nil
+}
+
+func TestSizePercentile(t *testing.T) {
+	var info partitionInfo
+	for size := int64(1); size <= 100; size++ {
+		info.observe(types.Object{Size: size})
+	}
+	if info.MinSize != 1 || info.MaxSize != 100 || info.averageSize() != 50.5 {
+		t.Errorf("expected sizes from 1 to 100 averaging 50.5, actual %d to %d averaging %v", info.MinSize, info.MaxSize, info.averageSize())
+	}
+	for _, q := range []float64{0.5, 0.95} {
+		expected := q * 100
+		if actual := info.sizePercentile(q); actual < expected*0.9 || actual > expected*1.1 {
+			t.Errorf("sizePercentile(%v): expected about %v, actual %v", q, expected, actual)
+		}
+	}
+	if actual := (&partitionInfo{}).sizePercentile(0.5); !math.IsNaN(actual) {
+		t.Errorf("sizePercentile of an empty partition: expected NaN, actual %v", actual)
+	}
+}
+
+var mergeObjectSizesTests = []struct {
+	aggregation string    // query aggregation JSON, if any
+	expected    []float64 // expected daily avg, min, max and p50 sizes
+}{
+	// Without an aggregation, the day is one partition of four objects, not
+	// the average of the hourly averages (550) nor the sum of the hourly
+	// minimums.
+	{``, []float64{325, 100, 1000, 100}},
+	{`, "aggregation": "merge"`, []float64{325, 100, 1000, 100}},
+	{`, "aggregation": "sum"`, []float64{1100, 1100, 1100, 1100}},
+}
+
+func TestQueryMergesObjectSizes(t *testing.T) {
+	var client S3APIClient = ObjectsOnlyS3Client{ListObjectsV2APIClient: SizesS3Client{
+		"hour=00": {100, 100, 100},
+		"hour=01": {1000},
+	}}
+	ds := SampleDatasource{Client: &client}
+	for _, testCase := range mergeObjectSizesTests {
+		query := backend.DataQuery{
+			TimeRange: backend.TimeRange{
+				From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+				To:   time.Date(2021, 9, 25, 3, 0, 0, 0, time.UTC),
+			},
+			JSON: []byte(`{"prefix": "hour=<HH>", "metrics": ["avg_size", "min_size", "max_size", "p50_size"]` + testCase.aggregation + `}`),
+		}
+		response := ds.query(context.Background(), backend.PluginContext{}, query)
+		if response.Error != nil {
+			t.Fatal(response.Error)
+		}
+		fields := response.Frames[0].Fields
+		for i, value := range testCase.expected {
+			if actual := fields[i+1].At(0).(float64); actual != value {
+				t.Errorf("%s%s: expected %v, actual %v", fields[i+1].Name, testCase.aggregation, value, actual)
+			}
+		}
+	}
+
+	// The hour=02 partition has not landed: its sizes are not 0 bytes.
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 25, 3, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "hour=<HH>", "aggregateBy": "raw", "metrics": ["avg_size", "min_size", "max_size", "p50_size", "p95_size"]}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	for _, field := range response.Frames[0].Fields[1:] {
+		if last := field.At(field.Len() - 1).(float64); !math.IsNaN(last) {
+			t.Errorf("%s of an empty partition: expected NaN, actual %v", field.Name, last)
+		}
+	}
+}
+
+// ModifiedS3Client serves, under each prefix, one object per LastModified.
+type ModifiedS3Client map[string][]time.Time
+
+func (client ModifiedS3Client) ListObjectsV2(_ context.Context, input *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	output := &s3.ListObjectsV2Output{}
+	for i := range client[*input.Prefix] {
+		key := *input.Prefix + "/" + strconv.Itoa(i)
+		output.Contents = append(output.Contents, types.Object{Key: &key, LastModified: &client[*input.Prefix][i]})
+	}
+	return output, nil
+}
+
+var freshnessTests = []struct {
+	aggregateBy string    // query aggregateBy
+	expected    []float64 // expected newest, oldest and latency of the first point
+}{
+	{"raw", []float64{1632531000000, 1632530400000, 3000}},
+	{"day", []float64{1632533400000, 1632530400000, 3000}},
+}
+
+func TestQueryFreshnessMetrics(t *testing.T) {
+	var client S3APIClient = ObjectsOnlyS3Client{ListObjectsV2APIClient: ModifiedS3Client{
+		"hour=00": {
+			time.Date(2021, 9, 25, 0, 40, 0, 0, time.UTC),
+			time.Date(2021, 9, 25, 0, 50, 0, 0, time.UTC),
+		},
+		"hour=01": {time.Date(2021, 9, 25, 1, 30, 0, 0, time.UTC)},
+	}}
+	ds := SampleDatasource{Client: &client}
+	for _, testCase := range freshnessTests {
+		query := backend.DataQuery{
+			TimeRange: backend.TimeRange{
+				From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+				To:   time.Date(2021, 9, 25, 3, 0, 0, 0, time.UTC),
+			},
+			JSON: []byte(`{"prefix": "hour=<HH>", "aggregateBy": "` + testCase.aggregateBy + `", "metrics": ["newest_modified", "oldest_modified", "arrival_latency"]}`),
+		}
+		response := ds.query(context.Background(), backend.PluginContext{}, query)
+		if response.Error != nil {
+			t.Fatal(response.Error)
+		}
+		fields := response.Frames[0].Fields
+		for i, value := range testCase.expected {
+			if actual := fields[i+1].At(0).(float64); actual != value {
+				t.Errorf("%s by %s: expected %v, actual %v", fields[i+1].Name, testCase.aggregateBy, value, actual)
+			}
+		}
+		// The hour=02 partition has not landed.
+		for i := 1; testCase.aggregateBy == "raw" && i < len(fields); i++ {
+			if last := fields[i].At(fields[i].Len() - 1).(float64); !math.IsNaN(last) {
+				t.Errorf("%s of an empty partition: expected NaN, actual %v", fields[i].Name, last)
+			}
+		}
+	}
+}
+
+// ObjectsS3Client serves the listed objects under each prefix.
+type ObjectsS3Client map[string][]types.Object
+
+func (client ObjectsS3Client) ListObjectsV2(_ context.Context, input *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return &s3.ListObjectsV2Output{Contents: client[*input.Prefix]}, nil
+}
+
+func TestQueryByStorageClass(t *testing.T) {
+	var client S3APIClient = ObjectsOnlyS3Client{ListObjectsV2APIClient: ObjectsS3Client{
+		"hour=00": {
+			{Key: aws.String("a"), Size: 10, StorageClass: types.ObjectStorageClassStandard},
+			{Key: aws.String("b"), Size: 100, StorageClass: types.ObjectStorageClassGlacier},
+		},
+		"hour=01": {{Key: aws.String("c"), Size: 5}},
+	}}
+	ds := SampleDatasource{Client: &client}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 25, 2, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "hour=<HH>", "metrics": ["size", "keys"], "byStorageClass": true}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	fields := response.Frames[0].Fields
+	expected := []struct {
+		class string
+		name  string
+		value float64
+	}{
+		{"GLACIER", "Size storageClass=GLACIER", 100},
+		{"GLACIER", "Number of keys storageClass=GLACIER", 1},
+		{"STANDARD", "Size storageClass=STANDARD", 15},
+		{"STANDARD", "Number of keys storageClass=STANDARD", 2},
+	}
+	if len(fields) != len(expected)+1 {
+		t.Fatalf("expected %d fields, actual %d", len(expected)+1, len(fields))
+	}
+	for i, e := range expected {
+		field := fields[i+1]
+		if field.Labels[labelStorageClass] != e.class || field.Config.DisplayNameFromDS != e.name || field.At(0).(float64) != e.value {
+			t.Errorf("field %d: expected %s = %v, actual %s %v = %v", i+1, e.name, e.value, field.Config.DisplayNameFromDS, field.Labels, field.At(0))
+		}
+	}
+}
+
+// VersionsS3Client serves pages of versions and delete markers, following the
+// key marker like S3 does.
+type VersionsS3Client struct {
+	MockS3Client
+	pages  []s3.ListObjectVersionsOutput
+	inputs []*s3.ListObjectVersionsInput
+	payers []string
+	mu     sync.Mutex
+}
+
+func (client *VersionsS3Client) ListObjectVersions(_ context.Context, input *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	client.mu.Lock()
+	client.inputs = append(client.inputs, input)
+	client.payers = append(client.payers, requestPayer(optFns...))
+	client.mu.Unlock()
+	page := 0
+	if input.KeyMarker != nil {
+		var err error
+		page, err = strconv.Atoi(*input.KeyMarker)
+		if err != nil {
+			return nil, err
+		}
+	}
+	output := client.pages[page]
+	if page+1 < len(client.pages) {
+		output.IsTruncated = true
+		output.NextKeyMarker = aws.String(strconv.Itoa(page + 1))
+		output.NextVersionIdMarker = aws.String("version")
+	}
+	return &output, nil
+}
+
+func newVersionsS3Client() *VersionsS3Client {
+	return &VersionsS3Client{pages: []s3.ListObjectVersionsOutput{
+		{
+			Versions: []types.ObjectVersion{
+				{Key: aws.String("a"), Size: 10, IsLatest: true},
+				{Key: aws.String("a"), Size: 7},
+			},
+			DeleteMarkers: []types.DeleteMarkerEntry{{Key: aws.String("b"), IsLatest: true}},
+		},
+		{
+			Versions: []types.ObjectVersion{
+				{Key: aws.String("b"), Size: 5},
+				{Key: aws.String("c"), Size: 3, IsLatest: true, StorageClass: types.ObjectVersionStorageClassStandard},
+			},
+		},
+	}}
+}
+
+func TestGetVersionsInfo(t *testing.T) {
+	client := newVersionsS3Client()
+	info, err := getVersionsInfo(context.Background(), client, "bucket", "prefix", listingOptions{ExpectedBucketOwner: "111122223333"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 13 || info.NumberOfKeys != 2 || info.NoncurrentSize != 12 || info.NoncurrentVersions != 2 || info.DeleteMarkers != 1 || info.Truncated {
+		t.Errorf("expected 13 bytes in 2 current versions, 12 bytes in 2 noncurrent versions and 1 delete marker, actual %+v", info)
+	}
+	if len(client.inputs) != 2 || aws.ToString(client.inputs[1].KeyMarker) != "1" || aws.ToString(client.inputs[1].VersionIdMarker) != "version" {
+		t.Errorf("expected a second page from the markers, actual %d calls", len(client.inputs))
+	}
+	if aws.ToString(client.inputs[0].ExpectedBucketOwner) != "111122223333" {
+		t.Errorf("expected the bucket owner to be sent, actual %q", aws.ToString(client.inputs[0].ExpectedBucketOwner))
+	}
+
+	if client.payers[0] != "" {
+		t.Errorf("expected no request payer, actual %q", client.payers[0])
+	}
+
+	client = newVersionsS3Client()
+	if _, err := getVersionsInfo(context.Background(), client, "bucket", "prefix", listingOptions{RequesterPays: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(client.payers, []string{"requester", "requester"}) {
+		t.Errorf("expected every page to be paid by the requester, actual %q", client.payers)
+	}
+
+	info, err = getVersionsInfo(context.Background(), newVersionsS3Client(), "bucket", "prefix", listingOptions{MaxPages: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Truncated || info.NoncurrentVersions != 1 {
+		t.Errorf("expected a truncated first page, actual %+v", info)
+	}
+}
+
+func TestQueryListsVersionsForVersionMetrics(t *testing.T) {
+	mock := newVersionsS3Client()
+	var client S3APIClient = mock
+	ds := SampleDatasource{Client: &client}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 25, 1, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "hour=<HH>", "metrics": ["size", "noncurrent_size", "noncurrent_versions", "delete_markers"]}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	fields := response.Frames[0].Fields
+	expected := []float64{13, 12, 2, 1}
+	for i, value := range expected {
+		if actual := fields[i+1].At(0).(float64); actual != value {
+			t.Errorf("%s: expected %v, actual %v", fields[i+1].Name, value, actual)
+		}
+	}
+	if len(mock.inputs) != 2 || aws.ToString(mock.inputs[0].Prefix) != "hour=00" {
+		t.Errorf("expected hour=00 listed with ListObjectVersions, actual %d calls", len(mock.inputs))
+	}
+}
+
+// UploadsS3Client serves the multipart uploads under each prefix, one page
+// per upload, and the sizes of their parts by upload ID. Listing the parts of
+// another upload fails with NoSuchUpload, and listing objects fails.
+type UploadsS3Client struct {
+	MockS3Client
+	uploads map[string][]types.MultipartUpload
+	parts   map[string][]int64
+	mu      sync.Mutex
+	payers  []string
+}
+
+func (client *UploadsS3Client) ListObjectsV2(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return nil, errors.New("unexpected ListObjectsV2")
+}
+
+func (client *UploadsS3Client) ListMultipartUploads(_ context.Context, input *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	client.mu.Lock()
+	client.payers = append(client.payers, requestPayer(optFns...))
+	client.mu.Unlock()
+	uploads := client.uploads[*input.Prefix]
+	page := 0
+	if input.KeyMarker != nil {
+		var err error
+		page, err = strconv.Atoi(*input.KeyMarker)
+		if err != nil {
+			return nil, err
+		}
+	}
+	output := &s3.ListMultipartUploadsOutput{}
+	if page < len(uploads) {
+		output.Uploads = uploads[page : page+1]
+	}
+	if page+1 < len(uploads) {
+		output.IsTruncated = true
+		output.NextKeyMarker = aws.String(strconv.Itoa(page + 1))
+		output.NextUploadIdMarker = uploads[page].UploadId
+	}
+	return output, nil
+}
+
+func (client *UploadsS3Client) ListParts(_ context.Context, input *s3.ListPartsInput, _ ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	parts, ok := client.parts[*input.UploadId]
+	if !ok {
+		return nil, &types.NoSuchUpload{Message: aws.String("mocked")}
+	}
+	output := &s3.ListPartsOutput{}
+	for i, size := range parts {
+		output.Parts = append(output.Parts, types.Part{PartNumber: int32(i + 1), Size: size})
+	}
+	return output, nil
+}
+
+var addUploadsInfoTests = []struct {
+	options   listingOptions // listing options
+	bytes     int64          // expected uploaded bytes
+	truncated bool           // expected truncation flag
+}{
+	{listingOptions{UploadParts: true}, 18, false},
+	{listingOptions{UploadParts: true, MaxKeys: 3}, 18, false},
+	{listingOptions{UploadParts: true, MaxKeys: 1}, 5, true},
+	{listingOptions{UploadParts: true, MaxKeys: 2}, 11, true},
+	{listingOptions{UploadParts: true, MaxPages: 1}, 11, true},
+}
+
+func TestAddUploadsInfoCeilings(t *testing.T) {
+	for _, testCase := range addUploadsInfoTests {
+		client := &UploadsS3Client{
+			uploads: map[string][]types.MultipartUpload{"prefix": {
+				{Key: aws.String("prefix/a"), UploadId: aws.String("1")},
+				{Key: aws.String("prefix/b"), UploadId: aws.String("2")},
+			}},
+			parts: map[string][]int64{"1": {5, 6}, "2": {7}},
+		}
+		var info partitionInfo
+		if err := addUploadsInfo(context.Background(), client, "bucket", "prefix", testCase.options, &info); err != nil {
+			t.Fatal(err)
+		}
+		if info.UploadedBytes != testCase.bytes || info.Truncated != testCase.truncated {
+			t.Errorf("addUploadsInfo(%+v): expected %d bytes, truncated %t, actual %d bytes, truncated %t",
+				testCase.options, testCase.bytes, testCase.truncated, info.UploadedBytes, info.Truncated)
+		}
+	}
+}
+
+func TestAddUploadsInfoRequesterPays(t *testing.T) {
+	client := &UploadsS3Client{uploads: map[string][]types.MultipartUpload{}}
+	var info partitionInfo
+	if err := addUploadsInfo(context.Background(), client, "bucket", "prefix", listingOptions{RequesterPays: true}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(client.payers, []string{"requester"}) {
+		t.Errorf("expected the uploads to be listed at the requester's expense, actual %q", client.payers)
+	}
+}
+
+var setListingsTests = []struct {
+	metrics  []string // metric IDs
+	expected listings // expected listings
+}{
+	{[]string{metricSize}, listings{}},
+	{[]string{metricSize, metricDeleteMarkers}, listings{Versions: true}},
+	{[]string{metricSize, metricUploads}, listings{Uploads: true}},
+	{[]string{metricUploads, metricOldestUploadAge}, listings{Uploads: true, UploadsOnly: true}},
+	{[]string{metricUploadedBytes}, listings{Uploads: true, UploadParts: true, UploadsOnly: true}},
+}
+
+func TestSetListings(t *testing.T) {
+	for _, testCase := range setListingsTests {
+		var queryMetrics []metric
+		for _, id := range testCase.metrics {
+			queryMetrics = append(queryMetrics, metrics[id])
+		}
+		var options listingOptions
+		options.setListings(queryMetrics)
+		if options.listings() != testCase.expected {
+			t.Errorf("setListings(%v): expected %+v, actual %+v", testCase.metrics, testCase.expected, options.listings())
+		}
+	}
+}
+
+func TestQueryMultipartUploads(t *testing.T) {
+	initiated := time.Now().Add(-2 * time.Hour)
+	var client S3APIClient = &UploadsS3Client{
+		uploads: map[string][]types.MultipartUpload{
+			"hour=00": {
+				{Key: aws.String("hour=00/a"), UploadId: aws.String("1"), Initiated: aws.Time(initiated.Add(time.Hour))},
+				{Key: aws.String("hour=00/b"), UploadId: aws.String("2"), Initiated: aws.Time(initiated)},
+				// Completed after it was listed.
+				{Key: aws.String("hour=00/c"), UploadId: aws.String("3"), Initiated: aws.Time(initiated.Add(-time.Hour))},
+			},
+		},
+		parts: map[string][]int64{"1": {5, 6}, "2": {7}},
+	}
+	ds := SampleDatasource{Client: &client}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 25, 2, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "hour=<HH>", "metrics": ["uploads", "oldest_upload_age", "uploaded_bytes"]}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	fields := response.Frames[0].Fields
+	if uploads := fields[1].At(0).(float64); uploads != 2 {
+		t.Errorf("expected 2 uploads, actual %v", uploads)
+	}
+	if age := fields[2].At(0).(float64); age < 7200 || age > 7260 {
+		t.Errorf("expected the oldest upload to be 2 hours old, actual %v seconds", age)
+	}
+	if size := fields[3].At(0).(float64); size != 18 {
+		t.Errorf("expected 18 uploaded bytes, actual %v", size)
+	}
+}
+
+// BucketS3Client serves the objects of a bucket by key, with the common
+// prefixes of delimiter listings, in a single page unless pageSize bounds
+// the common prefixes per page. A delimiter listing of the failing prefix
+// fails with err, and one of the blocked prefix waits for the context to be
+// done.
+type BucketS3Client struct {
+	UnmockedS3Client
+	objects   map[string]int64
+	pageSize  int
+	failing   string
+	err       error
+	blocked   string
+	mu        sync.Mutex
+	delimited []string
+}
+
+func (client *BucketS3Client) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	prefix := aws.ToString(input.Prefix)
+	delimiter := aws.ToString(input.Delimiter)
+	if delimiter != "" {
+		client.mu.Lock()
+		client.delimited = append(client.delimited, prefix)
+		client.mu.Unlock()
+		if client.failing != "" && prefix == client.failing {
+			return nil, client.err
+		}
+		if client.blocked != "" && prefix == client.blocked {
+			<-ctx.Done()
+			return nil, &smithy.OperationError{ServiceID: "S3", OperationName: "ListObjectsV2", Err: ctx.Err()}
+		}
+	}
+
+	keys := make([]string, 0, len(client.objects))
+	for key := range client.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	output := &s3.ListObjectsV2Output{}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			commonPrefix := key[:len(prefix)+i+len(delimiter)]
+			if !seen[commonPrefix] {
+				seen[commonPrefix] = true
+				output.CommonPrefixes = append(output.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(commonPrefix)})
+			}
+			continue
+		}
+		output.Contents = append(output.Contents, types.Object{Key: aws.String(key), Size: client.objects[key]})
+	}
+	if client.pageSize > 0 {
+		start := 0
+		if input.ContinuationToken != nil {
+			start, _ = strconv.Atoi(*input.ContinuationToken)
+		}
+		commonPrefixes := output.CommonPrefixes[start:]
+		if len(commonPrefixes) > client.pageSize {
+			commonPrefixes = commonPrefixes[:client.pageSize]
+			output.IsTruncated = true
+			output.NextContinuationToken = aws.String(strconv.Itoa(start + client.pageSize))
+		}
+		output.CommonPrefixes = commonPrefixes
+	}
+	return output, nil
+}
+
+func newHiveS3Client() *BucketS3Client {
+	return &BucketS3Client{objects: map[string]int64{
+		"client=1000/date=2021-09-25/hour=00/a": 10,
+		"client=1000/date=2021-09-25/hour=00/b": 20,
+		"client=1000/date=2021-09-25/hour=01/a": 5,
+		"client=2000/date=2021-09-25/hour=00/a": 7,
+		"tmp/date=2021-09-25/hour=00/a":         100,
+	}}
+}
+
+var groupByTests = []struct {
+	groupBy  string    // query groupBy JSON
+	names    []string  // expected display names
+	expected []float64 // expected daily sizes
+}{
+	{`["client"]`, []string{"client=1000", "client=2000"}, []float64{35, 7}},
+	{`[]`, []string{"Size"}, []float64{42}},
+}
+
+func TestQueryGroupsByPartitionKey(t *testing.T) {
+	for _, testCase := range groupByTests {
+		mock := newHiveS3Client()
+		var client S3APIClient = mock
+		ds := SampleDatasource{Client: &client}
+		query := backend.DataQuery{
+			TimeRange: backend.TimeRange{
+				From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+				To:   time.Date(2021, 9, 25, 2, 0, 0, 0, time.UTC),
+			},
+			JSON: []byte(`{"prefix": "client=*/date=<yyyy-MM-dd>/hour=<HH>", "metric": "size", "groupBy": ` + testCase.groupBy + `}`),
+		}
+		response := ds.query(context.Background(), backend.PluginContext{}, query)
+		if response.Error != nil {
+			t.Fatal(response.Error)
+		}
+		fields := response.Frames[0].Fields
+		if len(fields) != len(testCase.names)+1 {
+			t.Fatalf("groupBy %s: expected %d fields, actual %d", testCase.groupBy, len(testCase.names)+1, len(fields))
+		}
+		for i, name := range testCase.names {
+			field := fields[i+1]
+			if field.Config.DisplayNameFromDS != name || field.At(0).(float64) != testCase.expected[i] {
+				t.Errorf("groupBy %s: expected %s = %v, actual %s = %v", testCase.groupBy, name, testCase.expected[i], field.Config.DisplayNameFromDS, field.At(0))
+			}
+		}
+		// The clients are discovered once for both hours.
+		if !reflect.DeepEqual(mock.delimited, []string{""}) {
+			t.Errorf("groupBy %s: expected a single delimiter listing of the bucket, actual %q", testCase.groupBy, mock.delimited)
+		}
+	}
+}
+
+var expandBracesTests = []struct {
+	pattern  string   // glob pattern
+	expected []string // expected alternatives
+}{
+	{"eu-*", []string{"eu-*"}},
+	{"{eu,us}-{1,2}", []string{"eu-1", "eu-2", "us-1", "us-2"}},
+	{"a{b,{c,d}}", []string{"ab", "ac", "ad"}},
+	{"{a", []string{"{a"}},
+}
+
+func TestExpandBraces(t *testing.T) {
+	for _, testCase := range expandBracesTests {
+		actual := expandBraces(testCase.pattern)
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("expandBraces(%s): expected %q, actual %q", testCase.pattern, testCase.expected, actual)
+		}
+	}
+}
+
+var globMatchTests = []struct {
+	glob     string // prefix template segment
+	segment  string // segment of the bucket
+	expected bool   // expected match
+}{
+	{"region=eu-*", "region=eu-west", true},
+	{"region=eu-*", "region=us-east", false},
+	{"region=eu-*", "client=eu-west", false},
+	{"log-?", "log-1", true},
+	{"log-?", "log-12", false},
+	{"[a-c]x", "bx", true},
+	{"[!a-c]x", "bx", false},
+	{"{a,b}*", "bz", true},
+}
+
+func TestGlobSegmentMatch(t *testing.T) {
+	for _, testCase := range globMatchTests {
+		glob, ok := parseGlobSegment(testCase.glob, 1)
+		if !ok {
+			t.Fatalf("parseGlobSegment(%s): expected a glob", testCase.glob)
+		}
+		if _, actual := glob.match(testCase.segment); actual != testCase.expected {
+			t.Errorf("match(%s, %s): expected %t, actual %t", testCase.glob, testCase.segment, testCase.expected, actual)
+		}
+	}
+}
+
+func newGlobS3Client() *BucketS3Client {
+	return &BucketS3Client{objects: map[string]int64{
+		"region=eu-west/client=1/date=2021-09-25/a":  1,
+		"region=eu-north/client=1/date=2021-09-25/a": 2,
+		"region=us-east/client=1/date=2021-09-25/a":  4,
+		"region=eu-west/client=2/date=2021-09-25/a":  8,
+	}}
+}
+
+var globQueryTests = []struct {
+	json      string    // query JSON, without the closing brace
+	names     []string  // expected display names
+	expected  []float64 // expected daily sizes
+	delimited int       // expected number of delimiter listings
+}{
+	{`{"prefix": "region=eu-*/client=*/date=<yyyy-MM-dd>"`, []string{"Size"}, []float64{11}, 3},
+	{`{"prefix": "region=eu-*/client=*/date=<yyyy-MM-dd>", "splitMatches": true`,
+		[]string{"client=1, region=eu-north", "client=1, region=eu-west", "client=2, region=eu-west"}, []float64{2, 1, 8}, 3},
+	{`{"prefix": "region=eu-*/client=*/date=<yyyy-MM-dd>", "groupBy": ["region"]`,
+		[]string{"region=eu-north", "region=eu-west"}, []float64{2, 9}, 3},
+	{`{"prefix": "region={eu-west,us-east}/client=1/date=<yyyy-MM-dd>", "splitMatches": true`,
+		[]string{"region=eu-west", "region=us-east"}, []float64{1, 4}, 0},
+	{`{"prefix": "*/client=2/date=<yyyy-MM-dd>", "splitMatches": true`,
+		[]string{"match1=region=eu-north", "match1=region=eu-west", "match1=region=us-east"}, []float64{0, 8, 0}, 1},
+}
+
+func TestQueryExpandsGlobs(t *testing.T) {
+	for _, testCase := range globQueryTests {
+		mock := newGlobS3Client()
+		var client S3APIClient = mock
+		ds := SampleDatasource{Client: &client}
+		query := backend.DataQuery{
+			TimeRange: backend.TimeRange{
+				From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+				To:   time.Date(2021, 9, 26, 0, 0, 0, 0, time.UTC),
+			},
+			JSON: []byte(testCase.json + `, "metric": "size"}`),
+		}
+		response := ds.query(context.Background(), backend.PluginContext{}, query)
+		if response.Error != nil {
+			t.Fatalf("%s: %s", testCase.json, response.Error)
+		}
+		fields := response.Frames[0].Fields
+		if len(fields) != len(testCase.names)+1 {
+			t.Fatalf("%s: expected %d fields, actual %d", testCase.json, len(testCase.names)+1, len(fields))
+		}
+		for i, name := range testCase.names {
+			field := fields[i+1]
+			if field.Config.DisplayNameFromDS != name || field.At(0).(float64) != testCase.expected[i] {
+				t.Errorf("%s: expected %s = %v, actual %s = %v", testCase.json, name, testCase.expected[i], field.Config.DisplayNameFromDS, field.At(0))
+			}
+		}
+		if len(mock.delimited) != testCase.delimited {
+			t.Errorf("%s: expected %d delimiter listings, actual %q", testCase.json, testCase.delimited, mock.delimited)
+		}
+	}
+}
+
+var collidingValuesTests = []struct {
+	prefix    string // prefix template
+	delimited int    // expected number of delimiter listings
+}{
+	{"date=<yyyy-MM-dd>/client=*", 1},
+	{"date=<yyyy-MM-dd>/client=*/", 1},
+	{"date=<yyyy-MM-dd>/client={1000,10000}", 0},
+	{"date=<yyyy-MM-dd>/client=1000*", 1},
+}
+
+func TestQueryDoesNotMixValuesSharingAPrefix(t *testing.T) {
+	for _, testCase := range collidingValuesTests {
+		mock := &BucketS3Client{objects: map[string]int64{
+			"date=2021-09-25/client=1000/a":  1,
+			"date=2021-09-25/client=10000/a": 100,
+		}}
+		var client S3APIClient = mock
+		ds := SampleDatasource{Client: &client}
+		query := backend.DataQuery{
+			TimeRange: backend.TimeRange{
+				From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+				To:   time.Date(2021, 9, 26, 0, 0, 0, 0, time.UTC),
+			},
+			JSON: []byte(`{"prefix": "` + testCase.prefix + `", "metric": "size", "splitMatches": true}`),
+		}
+		response := ds.query(context.Background(), backend.PluginContext{}, query)
+		if response.Error != nil {
+			t.Fatalf("%s: %s", testCase.prefix, response.Error)
+		}
+		fields := response.Frames[0].Fields
+		expected := map[string]float64{"client=1000": 1, "client=10000": 100}
+		if len(fields) != len(expected)+1 {
+			t.Fatalf("%s: expected %d fields, actual %d", testCase.prefix, len(expected)+1, len(fields))
+		}
+		for _, field := range fields[1:] {
+			if value := field.At(0).(float64); value != expected[field.Config.DisplayNameFromDS] {
+				t.Errorf("%s: expected %s = %v, actual %v", testCase.prefix, field.Config.DisplayNameFromDS, expected[field.Config.DisplayNameFromDS], value)
+			}
+		}
+		if len(mock.delimited) != testCase.delimited {
+			t.Errorf("%s: expected %d delimiter listings, actual %q", testCase.prefix, testCase.delimited, mock.delimited)
+		}
+	}
+}
+
+func TestQueryIsolatesDiscoveryFailures(t *testing.T) {
+	var client S3APIClient = &BucketS3Client{
+		objects: map[string]int64{
+			"date=2021-09-25/client=1/a": 1,
+			"date=2021-09-26/client=1/a": 2,
+		},
+		failing: "date=2021-09-26/",
+		err:     responseError(503, "SlowDown", nil),
+	}
+	ds := SampleDatasource{Client: &client}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 27, 0, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "date=<yyyy-MM-dd>/client=*", "metric": "size"}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	frame := response.Frames[0]
+	if frame.Fields[0].Len() != 1 || frame.Fields[1].At(0).(float64) != 1 {
+		t.Errorf("expected the first day only, actual %d points", frame.Fields[0].Len())
+	}
+	if frame.Meta == nil || len(frame.Meta.Notices) != 1 || !strings.Contains(frame.Meta.Notices[0].Text, `(throttled) for 1 prefix(es), starting with "date=2021-09-26/client=*"`) {
+		t.Errorf("expected a failure notice for the second day, actual %+v", frame.Meta)
+	}
+}
+
+func TestQueryReturnsPartitionsDiscoveredBeforeTimeout(t *testing.T) {
+	mock := &BucketS3Client{objects: map[string]int64{
+		"date=2021-09-25/client=1/a": 1,
+		"date=2021-09-26/client=1/a": 2,
+	}}
+	var client S3APIClient = mock
+	ds := SampleDatasource{
+		Client:             &client,
+		cache:              newPartitionCache(100),
+		openPartitionTTL:   time.Minute,
+		closedPartitionTTL: time.Hour,
+	}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 26, 0, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "date=<yyyy-MM-dd>/client=*", "metric": "size"}`),
+	}
+	// The first day is listed, and cached, by an earlier query.
+	if response := ds.query(context.Background(), backend.PluginContext{}, query); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+
+	mock.blocked = "date=2021-09-26/"
+	query.TimeRange.To = time.Date(2021, 9, 27, 0, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	response := ds.query(ctx, backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	frame := response.Frames[0]
+	if frame.Fields[0].Len() != 1 || frame.Fields[1].At(0).(float64) != 1 {
+		t.Errorf("expected the first day only, actual %d points", frame.Fields[0].Len())
+	}
+	if frame.Meta == nil || len(frame.Meta.Notices) != 1 || !strings.Contains(frame.Meta.Notices[0].Text, "1 of 2 prefixes") {
+		t.Errorf("expected a discovery timeout notice, actual %+v", frame.Meta)
+	}
+}
+
+func TestDiscoverPartitionsListsParentsOnce(t *testing.T) {
+	mock := &BucketS3Client{objects: map[string]int64{
+		"client=1/date=2021-09-25/a": 1,
+		"client=2/date=2021-09-26/a": 2,
+	}}
+	prefixes := []string{"client=*/date=2021-09-25", "client=*/date=2021-09-26", "client=*/date=2021-09-27"}
+	discoveries, errs, err := discoverPartitions(context.Background(), mock, "bucket", prefixes, listingOptions{}, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, discovery := range discoveries {
+		if errs[i] != nil || discovery == nil || len(discovery.Partitions) != 2 || discovery.Partitions[0].TimeIndex != i {
+			t.Errorf("prefix %d: expected 2 partitions, actual %+v, %v", i, discovery, errs[i])
+		}
+	}
+	if !reflect.DeepEqual(mock.delimited, []string{""}) {
+		t.Errorf("expected a single delimiter listing of the bucket, actual %q", mock.delimited)
+	}
+}
+
+func TestQueryReportsTruncatedDiscovery(t *testing.T) {
+	var client S3APIClient = &BucketS3Client{
+		objects: map[string]int64{
+			"date=2021-09-25/client=1/a": 1,
+			"date=2021-09-25/client=2/a": 2,
+		},
+		pageSize: 1,
+	}
+	ds := SampleDatasource{Client: &client}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 26, 0, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "date=<yyyy-MM-dd>/client=*", "metric": "size", "maxPages": 1}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	frame := response.Frames[0]
+	if value := frame.Fields[1].At(0).(float64); value != 1 {
+		t.Errorf("expected the first client only, actual %v", value)
+	}
+	if frame.Meta == nil || len(frame.Meta.Notices) != 1 || !strings.Contains(frame.Meta.Notices[0].Text, `"date=2021-09-25/"`) {
+		t.Errorf("expected a truncation notice for the discovery, actual %+v", frame.Meta)
+	}
+}
+
+func TestQueryCapsGlobFanOut(t *testing.T) {
+	var client S3APIClient = newGlobS3Client()
+	ds := SampleDatasource{Client: &client}
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2021, 9, 25, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 9, 26, 0, 0, 0, 0, time.UTC),
+		},
+		JSON: []byte(`{"prefix": "region=*/client=*/date=<yyyy-MM-dd>", "maxMatches": 3}`),
+	}
+	response := ds.query(context.Background(), backend.PluginContext{}, query)
+	var queryErr *queryError
+	if !errors.As(response.Error, &queryErr) || queryErr.Source != errorSourceUser {
+		t.Fatalf("expected a user error past 3 matches, actual %v", response.Error)
+	}
+	var fanOutErr *fanOutError
+	if !errors.As(response.Error, &fanOutErr) || fanOutErr.MaxMatches != 3 {
+		t.Errorf("expected a fan-out error, actual %v", response.Error)
+	}
+}
@@ -2,6 +2,11 @@ package plugin_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -42,9 +47,32 @@ func TestNewSampleDatasourceWithCreds(t *testing.T) {
 }
 
 
+func TestNewSampleDatasourceWithSecureAccessKey(t *testing.T) {
+	var settings backend.DataSourceInstanceSettings
+	settings.JSONData = []byte("{\"authenticationProvider\": 1, \"sessionTokenExpiration\": \"2021-02-10T12:00:00Z\"}")
+	settings.DecryptedSecureJSONData = map[string]string{"accessKeyId": "test_key", "secretAccessKey": "test_secret", "sessionToken": "test_token"}
+	_, err := plugin.NewSampleDatasource(settings)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+
 func TestNewSampleDatasourceWithEndpoint(t *testing.T) {
 	var settings backend.DataSourceInstanceSettings
 	settings.JSONData = []byte("{\"authenticationProvider\": 1, \"accessKeyId\": \"test_key\", \"endpoint\": \"http://localhost:9000\"}")
+	settings.DecryptedSecureJSONData = map[string]string{"secretAccessKey": "test_secret"}
+	_, err := plugin.NewSampleDatasource(settings)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+
+func TestNewSampleDatasourceWithAssumeRole(t *testing.T) {
+	var settings backend.DataSourceInstanceSettings
+	settings.JSONData = []byte("{\"authenticationProvider\": 2, \"assumeRoleArn\": \"arn:aws:iam::123456789012:role/reader\", \"externalId\": \"team-a\", \"assumeRoleDuration\": 3600, \"assumeRoleBaseProvider\": 1, \"accessKeyId\": \"test_key\", \"defaultRegion\": \"us-east-1\"}")
+	settings.DecryptedSecureJSONData = map[string]string{"secretAccessKey": "test_secret"}
 	_, err := plugin.NewSampleDatasource(settings)
 	if err != nil {
 		t.Error(err)
@@ -52,6 +80,108 @@ func TestNewSampleDatasourceWithEndpoint(t *testing.T) {
 }
 
 
+func writeSharedCredentials(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "credentials")
+	content := "[reader]\naws_access_key_id = test_key\naws_secret_access_key = test_secret\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewSampleDatasourceWithSharedConfigProfile(t *testing.T) {
+	path := writeSharedCredentials(t)
+	var settings backend.DataSourceInstanceSettings
+	settings.JSONData = []byte(fmt.Sprintf("{\"authenticationProvider\": 3, \"profile\": \"reader\", \"credentialsFile\": %q}", path))
+	_, err := plugin.NewSampleDatasource(settings)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewSampleDatasourceWithUnknownSharedConfigProfile(t *testing.T) {
+	path := writeSharedCredentials(t)
+	var settings backend.DataSourceInstanceSettings
+	settings.JSONData = []byte(fmt.Sprintf("{\"authenticationProvider\": 3, \"profile\": \"writer\", \"credentialsFile\": %q}", path))
+	_, err := plugin.NewSampleDatasource(settings)
+	var configErr *plugin.ConfigError
+	if !errors.As(err, &configErr) {
+		t.Errorf("expected a ConfigError for an unknown profile, actual %v", err)
+	}
+}
+
+
+var invalidSettingsTests = []struct {
+	jsonData   string            // jsonData input
+	secureData map[string]string // secureJsonData input
+	field      string            // expected ConfigError field
+}{
+	{"{\"authenticationProvider\": 1, \"accessKeyId\": \"test_key\"}", nil, "secretAccessKey"},
+	{"{\"authenticationProvider\": 1}", map[string]string{"secretAccessKey": "test_secret"}, "accessKeyId"},
+	{"{\"authenticationProvider\": 1, \"sessionTokenExpiration\": \"tomorrow\"}", map[string]string{"accessKeyId": "test_key", "secretAccessKey": "test_secret", "sessionToken": "test_token"}, "sessionTokenExpiration"},
+	{"{\"authenticationProvider\": 1, \"sessionTokenExpiration\": \"2021-02-10T12:00:00Z\"}", map[string]string{"accessKeyId": "test_key", "secretAccessKey": "test_secret"}, "sessionToken"},
+	{"{\"authenticationProvider\": 7}", nil, "authenticationProvider"},
+	{"{\"proxyUrl\": \"proxy:3128\"}", nil, "proxyUrl"},
+	{"{\"responseTimeout\": -1}", nil, "responseTimeout"},
+	{"{\"retryMode\": \"adaptive\"}", nil, "retryMode"},
+	{"{\"tlsAuthWithCACert\": true}", nil, "tlsCACert"},
+	{"{\"tlsAuthWithCACert\": true}", map[string]string{"tlsCACert": "not a certificate"}, "tlsCACert"},
+	{"{\"tlsAuth\": true}", map[string]string{"tlsClientCert": "not a certificate"}, "tlsClientCert"},
+	{"{\"tlsAuth\": true}", map[string]string{"tlsClientCert": "not a certificate", "tlsClientKey": "not a key"}, "tlsClientCert"},
+	{"{\"authenticationProvider\": 2}", nil, "assumeRoleArn"},
+	{"{\"authenticationProvider\": 2, \"assumeRoleArn\": \"arn:aws:iam::123456789012:role/reader\", \"assumeRoleDuration\": 60}", nil, "assumeRoleDuration"},
+	{"{\"authenticationProvider\": 2, \"assumeRoleArn\": \"arn:aws:iam::123456789012:role/reader\", \"assumeRoleBaseProvider\": 2}", nil, "assumeRoleBaseProvider"},
+	{"{\"authenticationProvider\": 2, \"assumeRoleArn\": \"arn:aws:iam::123456789012:role/reader\", \"assumeRoleBaseProvider\": 1}", nil, "accessKeyId"},
+	{"{\"authenticationProvider\": 3}", nil, "profile"},
+	{"{\"authenticationProvider\": 3, \"profile\": \"reader\", \"credentialsFile\": \"/nonexistent/credentials\"}", nil, "credentialsFile"},
+	{"{\"endpoint\": \"localhost:9000\"}", nil, "endpoint"},
+	{"{\"endpoint\": \"ftp://localhost:9000\"}", nil, "endpoint"},
+	{"{\"endpoint\": \"http://local host\"}", nil, "endpoint"},
+}
+
+func TestNewSampleDatasourceWithInvalidSettings(t *testing.T) {
+	for _, testCase := range invalidSettingsTests {
+		var settings backend.DataSourceInstanceSettings
+		settings.JSONData = []byte(testCase.jsonData)
+		settings.DecryptedSecureJSONData = testCase.secureData
+		_, err := plugin.NewSampleDatasource(settings)
+		var configErr *plugin.ConfigError
+		if !errors.As(err, &configErr) || configErr.Field != testCase.field {
+			t.Errorf("NewSampleDatasource(%s): expected a ConfigError on %s, actual %v", testCase.jsonData, testCase.field, err)
+		}
+	}
+}
+
+func TestNewDatasourceInstanceReportsConfigError(t *testing.T) {
+	var settings backend.DataSourceInstanceSettings
+	settings.JSONData = []byte("{\"authenticationProvider\": 7}")
+	instance, err := plugin.NewDatasourceInstance(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := instance.(*plugin.SampleDatasource)
+
+	health, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Status != backend.HealthStatusError || !strings.Contains(health.Message, "unknown authentication provider 7") {
+		t.Errorf("expected CheckHealth to explain the configuration error, actual %s %q", health.Status, health.Message)
+	}
+
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var configErr *plugin.ConfigError
+	if !errors.As(resp.Responses["A"].Error, &configErr) {
+		t.Errorf("expected the query to return the configuration error, actual %v", resp.Responses["A"].Error)
+	}
+}
+
+
 func TestQueryDataWithError(t *testing.T) {
 	ds := plugin.SampleDatasource{}
 
@@ -87,9 +217,21 @@ func (client* MockS3Client) ListObjectsV2(context.Context, *s3.ListObjectsV2Inpu
 	}, nil
 }
 
+func (client* MockS3Client) ListObjectVersions(context.Context, *s3.ListObjectVersionsInput, ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	return nil, errors.New("mocked failure")
+}
+
+func (client* MockS3Client) ListMultipartUploads(context.Context, *s3.ListMultipartUploadsInput, ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	return nil, errors.New("mocked failure")
+}
+
+func (client* MockS3Client) ListParts(context.Context, *s3.ListPartsInput, ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	return nil, errors.New("mocked failure")
+}
+
 
 func TestQueryData(t *testing.T) {
-	var client s3.ListObjectsV2APIClient = &MockS3Client{}
+	var client plugin.S3APIClient = &MockS3Client{}
 	ds := plugin.SampleDatasource{
 		Client: &client,
 	}
@@ -120,7 +262,7 @@ func TestQueryData(t *testing.T) {
 		t.Fatal("QueryData must return a response")
 	}
 
-	if (to - from - 1) != resp.Responses["A"].Frames[0].Fields[1].Len() {
+	if (to - from) != resp.Responses["A"].Frames[0].Fields[1].Len() {
 		t.Fatal("wrong number of values")
 	}
 }
\ No newline at end of file
@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3BucketLocationAPIClient is implemented by clients that can discover the
+// region of a bucket. The *s3.Client built by NewSampleDatasource implements it.
+type s3BucketLocationAPIClient interface {
+	GetBucketLocation(context.Context, *s3.GetBucketLocationInput, ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error)
+}
+
+// bucketLocationRegion maps a GetBucketLocation LocationConstraint to a region
+// name. Buckets in us-east-1 report an empty constraint and some legacy
+// eu-west-1 buckets report "EU".
+func bucketLocationRegion(constraint string) string {
+	switch constraint {
+	case "":
+		return "us-east-1"
+	case "EU":
+		return "eu-west-1"
+	default:
+		return constraint
+	}
+}
+
+// regionLookupRetryInterval is how long the default region is used for a
+// bucket whose region could not be discovered, e.g. for lack of the
+// s3:GetBucketLocation permission, before asking S3 again.
+const regionLookupRetryInterval = 5 * time.Minute
+
+// bucketRegion returns the region of bucket, asking S3 once per bucket. An
+// empty region means it could not be discovered and the default client
+// should be used; failed lookups are retried after regionLookupRetryInterval.
+func (d *SampleDatasource) bucketRegion(ctx context.Context, bucket string, options listingOptions) string {
+	client, ok := (*d.Client).(s3BucketLocationAPIClient)
+	if !ok || bucket == "" {
+		return ""
+	}
+
+	d.clientsMu.Lock()
+	region, found := d.bucketRegions[bucket]
+	retryAt, failed := d.regionLookupFailures[bucket]
+	d.clientsMu.Unlock()
+	if found {
+		return region
+	}
+	if failed && time.Now().Before(retryAt) {
+		return ""
+	}
+
+	output, err := client.GetBucketLocation(ctx, &s3.GetBucketLocationInput{
+		Bucket:              aws.String(bucket),
+		ExpectedBucketOwner: options.expectedBucketOwner(),
+	})
+	if err != nil {
+		log.DefaultLogger.Warn("bucket region discovery failed, using the default region", "bucket", bucket, "err", err)
+		// A lookup cut short by the query says nothing about the bucket.
+		if ctx.Err() == nil {
+			d.clientsMu.Lock()
+			if d.regionLookupFailures == nil {
+				d.regionLookupFailures = make(map[string]time.Time)
+			}
+			d.regionLookupFailures[bucket] = time.Now().Add(regionLookupRetryInterval)
+			d.clientsMu.Unlock()
+		}
+		return ""
+	}
+	region = bucketLocationRegion(string(output.LocationConstraint))
+
+	d.clientsMu.Lock()
+	if d.bucketRegions == nil {
+		d.bucketRegions = make(map[string]string)
+	}
+	d.bucketRegions[bucket] = region
+	delete(d.regionLookupFailures, bucket)
+	d.clientsMu.Unlock()
+	return region
+}
+
+// clientForQuery returns the client for the query's region, discovering the
+// bucket's region when the query leaves it blank. Clients for regions other
+// than the default one are created on first use and kept for the lifetime of
+// the datasource instance.
+func (d *SampleDatasource) clientForQuery(ctx context.Context, qm queryModel) S3APIClient {
+	region := qm.Region
+	if region == "" {
+		region = d.bucketRegion(ctx, qm.Bucket, qm.listingOptions())
+	}
+	if region == "" || region == d.region || d.newRegionClient == nil {
+		return *d.Client
+	}
+
+	d.clientsMu.Lock()
+	defer d.clientsMu.Unlock()
+	client, ok := d.regionClients[region]
+	if !ok {
+		if d.regionClients == nil {
+			d.regionClients = make(map[string]S3APIClient)
+		}
+		client = d.newRegionClient(region)
+		d.regionClients[region] = client
+	}
+	return client
+}
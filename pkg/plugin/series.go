@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Labels set on the fields of split series.
+const labelStorageClass = "storageClass"
+
+// series is a subset of the objects of every listed partition, e.g. those of
+// one storage class, charted as its own labelled fields. Infos is aligned with
+// the listed partitions; a partition without objects in the series has an
+// empty summary.
+type series struct {
+	Labels data.Labels
+	Infos  []*partitionInfo
+}
+
+// storageClassSeries splits the partitions by storage class, one series per
+// class found in any of them, sorted by class.
+func storageClassSeries(infos []*partitionInfo) []series {
+	seen := make(map[string]bool)
+	var classes []string
+	for _, info := range infos {
+		for class := range info.StorageClasses {
+			if !seen[class] {
+				seen[class] = true
+				classes = append(classes, class)
+			}
+		}
+	}
+	sort.Strings(classes)
+
+	out := make([]series, 0, len(classes))
+	for _, class := range classes {
+		s := series{
+			Labels: data.Labels{labelStorageClass: class},
+			Infos:  make([]*partitionInfo, len(infos)),
+		}
+		for i, info := range infos {
+			s.Infos[i] = info.StorageClasses[class]
+			if s.Infos[i] == nil {
+				s.Infos[i] = &partitionInfo{}
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// displayName names the field of metric m in a series labelled labels, e.g.
+// "Size storageClass=GLACIER", or just the labels when the query has a single
+// metric.
+func displayName(m metric, labels data.Labels, singleMetric bool) string {
+	if len(labels) == 0 {
+		return m.Name
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%s=%s", key, labels[key])
+	}
+	name := strings.Join(pairs, ", ")
+	if singleMetric {
+		return name
+	}
+	return m.Name + " " + name
+}
+
+// groupSeries merges the partitions of every listed time that share the
+// values of the groupBy keys, one series per combination of values found,
+// sorted by labels. listed holds the indices of the listed times, in order.
+// Without groupBy keys, all the partitions of a time are merged.
+func groupSeries(partitions []partition, infos []*partitionInfo, listed []int, groupBy []string) []series {
+	positions := make(map[int]int, len(listed))
+	for p, i := range listed {
+		positions[i] = p
+	}
+
+	type group struct {
+		labels data.Labels
+		infos  [][]*partitionInfo
+	}
+	groups := make(map[string]*group)
+	var ids []string
+	for j, part := range partitions {
+		p, ok := positions[part.TimeIndex]
+		if !ok || infos[j] == nil {
+			continue
+		}
+		var labels data.Labels
+		if len(groupBy) > 0 {
+			labels = data.Labels{}
+			for _, key := range groupBy {
+				labels[key] = part.Labels[key]
+			}
+		}
+		id := labels.String()
+		g, ok := groups[id]
+		if !ok {
+			g = &group{labels: labels, infos: make([][]*partitionInfo, len(listed))}
+			groups[id] = g
+			ids = append(ids, id)
+		}
+		g.infos[p] = append(g.infos[p], infos[j])
+	}
+	if len(groupBy) == 0 && len(groups) == 0 {
+		groups[""] = &group{infos: make([][]*partitionInfo, len(listed))}
+		ids = append(ids, "")
+	}
+	sort.Strings(ids)
+
+	out := make([]series, 0, len(ids))
+	for _, id := range ids {
+		g := groups[id]
+		s := series{Labels: g.labels, Infos: make([]*partitionInfo, len(listed))}
+		for p, partitionInfos := range g.infos {
+			switch len(partitionInfos) {
+			case 0:
+				s.Infos[p] = &partitionInfo{}
+			case 1:
+				s.Infos[p] = partitionInfos[0]
+			default:
+				merged := &partitionInfo{}
+				for _, info := range partitionInfos {
+					merged.add(info)
+				}
+				s.Infos[p] = merged
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// splitByStorageClass splits every series into one per storage class.
+func splitByStorageClass(in []series) []series {
+	var out []series
+	for _, s := range in {
+		for _, classSeries := range storageClassSeries(s.Infos) {
+			for key, value := range s.Labels {
+				classSeries.Labels[key] = value
+			}
+			out = append(out, classSeries)
+		}
+	}
+	return out
+}
@@ -0,0 +1,330 @@
+package plugin
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Values of dataSourceConfig.AuthenticationProvider.
+const (
+	// authProviderDefault uses the AWS SDK default credential chain.
+	authProviderDefault = 0
+	// authProviderKeys uses a static access key ID and secret access key.
+	authProviderKeys = 1
+	// authProviderAssumeRole assumes assumeRoleArn using the default chain or
+	// static keys, as selected by assumeRoleBaseProvider, as base credentials.
+	authProviderAssumeRole = 2
+	// authProviderSharedConfig uses a named profile of the shared config
+	// and credentials files.
+	authProviderSharedConfig = 3
+	// authProviderWebIdentity exchanges a web identity (OIDC) token file
+	// for credentials of a role, e.g. IAM roles for service accounts on EKS.
+	authProviderWebIdentity = 4
+)
+
+type dataSourceConfig struct {
+	AuthenticationProvider int `json:"authenticationProvider"`
+	// AccessKeyId is the legacy location of the access key ID; the
+	// accessKeyId secure JSON field takes precedence.
+	AccessKeyId string `json:"accessKeyId"`
+	// SessionTokenExpiration optionally records when temporary static
+	// credentials expire (RFC 3339), so CheckHealth can warn ahead of time.
+	SessionTokenExpiration string `json:"sessionTokenExpiration"`
+
+	Endpoint string `json:"endpoint"`
+	// ForcePathStyle selects path-style (true) or virtual-hosted-style (false)
+	// bucket addressing. When unset, a custom endpoint is addressed
+	// path-style and AWS virtual-hosted-style.
+	ForcePathStyle *bool `json:"forcePathStyle"`
+	// StsEndpoint optionally overrides the STS endpoint used by the assume
+	// role and web identity providers.
+	StsEndpoint string `json:"stsEndpoint"`
+	// DefaultRegion overrides the region from the Grafana server environment.
+	DefaultRegion string `json:"defaultRegion"`
+
+	// Assume role authentication. AssumeRoleDuration is in seconds.
+	// AssumeRoleSessionName also names web identity sessions.
+	AssumeRoleArn          string `json:"assumeRoleArn"`
+	ExternalId             string `json:"externalId"`
+	AssumeRoleSessionName  string `json:"assumeRoleSessionName"`
+	AssumeRoleDuration     int    `json:"assumeRoleDuration"`
+	AssumeRoleBaseProvider int    `json:"assumeRoleBaseProvider"`
+
+	// Shared config authentication. Empty file paths use the SDK defaults
+	// (~/.aws/credentials and ~/.aws/config).
+	Profile         string `json:"profile"`
+	CredentialsFile string `json:"credentialsFile"`
+	ConfigFile      string `json:"configFile"`
+
+	// Web identity authentication. Empty values default to the
+	// AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN environment variables.
+	WebIdentityTokenFile string `json:"webIdentityTokenFile"`
+	WebIdentityRoleArn   string `json:"webIdentityRoleArn"`
+
+	// TLS options of the HTTP client, named like Grafana's own data source
+	// settings. The PEM CA bundle and client key pair are secure JSON data
+	// (tlsCACert, tlsClientCert and tlsClientKey).
+	TLSAuth           bool `json:"tlsAuth"`
+	TLSAuthWithCACert bool `json:"tlsAuthWithCACert"`
+	TLSSkipVerify     bool `json:"tlsSkipVerify"`
+
+	// Connection options of the HTTP client. ProxyURL overrides the
+	// HTTP(S)_PROXY environment variables; timeouts are in seconds, and
+	// ResponseTimeout bounds each request including reading the response.
+	ProxyURL        string `json:"proxyUrl"`
+	ConnectTimeout  int    `json:"connectTimeout"`
+	ResponseTimeout int    `json:"responseTimeout"`
+	MaxIdleConns    int    `json:"maxIdleConns"`
+	// Retries: RetryMode is "standard" (default) or "off"; MaxAttempts
+	// includes the first attempt and defaults to 3.
+	RetryMode   string `json:"retryMode"`
+	MaxAttempts int    `json:"maxAttempts"`
+
+	Concurrency int `json:"concurrency"`
+	// DefaultBucket is optionally checked by CheckHealth with HeadBucket.
+	DefaultBucket string `json:"defaultBucket"`
+	// RequesterPays and ExpectedBucketOwner are the defaults of the query
+	// options of the same name.
+	RequesterPays       bool   `json:"requesterPays"`
+	ExpectedBucketOwner string `json:"expectedBucketOwner"`
+	// Partition listing cache. TTLs are in seconds; a negative
+	// cacheMaxEntries disables the cache.
+	CacheMaxEntries         int `json:"cacheMaxEntries"`
+	OpenPartitionCacheTTL   int `json:"openPartitionCacheTTL"`
+	ClosedPartitionCacheTTL int `json:"closedPartitionCacheTTL"`
+}
+
+// ConfigError reports a datasource configuration that cannot produce a working
+// S3 client. Field names the offending jsonData or secureJsonData key, if any.
+type ConfigError struct {
+	Field  string
+	Reason string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	msg := "invalid data source configuration"
+	if e.Field != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Field)
+	}
+	msg = fmt.Sprintf("%s: %s", msg, e.Reason)
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %s", msg, e.Err)
+	}
+	return msg
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// reportsIdentity tells whether CheckHealth should report the caller identity,
+// which is not obvious from the settings for these providers.
+func (dsConfig dataSourceConfig) reportsIdentity() bool {
+	switch dsConfig.AuthenticationProvider {
+	case authProviderAssumeRole, authProviderSharedConfig, authProviderWebIdentity:
+		return true
+	}
+	return false
+}
+
+// webIdentity returns the token file and role ARN of the web identity
+// provider, falling back to the variables the SDK reads on EKS.
+func (dsConfig dataSourceConfig) webIdentity() (string, string) {
+	tokenFile := dsConfig.WebIdentityTokenFile
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	roleArn := dsConfig.WebIdentityRoleArn
+	if roleArn == "" {
+		roleArn = os.Getenv("AWS_ROLE_ARN")
+	}
+	return tokenFile, roleArn
+}
+
+// Bounds of the session duration STS accepts for AssumeRole, in seconds.
+const (
+	minAssumeRoleDuration = 900
+	maxAssumeRoleDuration = 43200
+)
+
+// accessKeyID returns the access key ID from the secure JSON data, falling
+// back to the plain jsonData field of older configurations.
+func (dsConfig dataSourceConfig) accessKeyID(secureData map[string]string) string {
+	if accessKeyID := secureData["accessKeyId"]; accessKeyID != "" {
+		return accessKeyID
+	}
+	return dsConfig.AccessKeyId
+}
+
+// sessionTokenExpiry parses SessionTokenExpiration; the zero time means unknown.
+func (dsConfig dataSourceConfig) sessionTokenExpiry() (time.Time, error) {
+	if dsConfig.SessionTokenExpiration == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, dsConfig.SessionTokenExpiration)
+}
+
+func (dsConfig dataSourceConfig) validateKeys(secureData map[string]string) error {
+	if dsConfig.accessKeyID(secureData) == "" {
+		return &ConfigError{Field: "accessKeyId", Reason: "is required for access & secret key authentication"}
+	}
+	if secureData["secretAccessKey"] == "" {
+		return &ConfigError{Field: "secretAccessKey", Reason: "is required for access & secret key authentication"}
+	}
+	if _, err := dsConfig.sessionTokenExpiry(); err != nil {
+		return &ConfigError{Field: "sessionTokenExpiration", Reason: "must be an RFC 3339 timestamp", Err: err}
+	}
+	if dsConfig.SessionTokenExpiration != "" && secureData["sessionToken"] == "" {
+		return &ConfigError{Field: "sessionToken", Reason: "is required when sessionTokenExpiration is set"}
+	}
+	return nil
+}
+
+// validateFile checks that an optional file setting names an existing file.
+func validateFile(field string, path string) error {
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return &ConfigError{Field: field, Reason: "cannot be read", Err: err}
+	}
+	return nil
+}
+
+// validate checks the settings that would otherwise only fail once S3 is called.
+func (dsConfig dataSourceConfig) validate(secureData map[string]string) error {
+	switch dsConfig.AuthenticationProvider {
+	case authProviderDefault:
+	case authProviderKeys:
+		if err := dsConfig.validateKeys(secureData); err != nil {
+			return err
+		}
+	case authProviderAssumeRole:
+		if !strings.HasPrefix(dsConfig.AssumeRoleArn, "arn:") {
+			return &ConfigError{Field: "assumeRoleArn", Reason: "must be a role ARN for assume role authentication"}
+		}
+		if dsConfig.AssumeRoleDuration != 0 && (dsConfig.AssumeRoleDuration < minAssumeRoleDuration || dsConfig.AssumeRoleDuration > maxAssumeRoleDuration) {
+			return &ConfigError{Field: "assumeRoleDuration", Reason: fmt.Sprintf("must be between %d and %d seconds", minAssumeRoleDuration, maxAssumeRoleDuration)}
+		}
+		switch dsConfig.AssumeRoleBaseProvider {
+		case authProviderDefault:
+		case authProviderKeys:
+			if err := dsConfig.validateKeys(secureData); err != nil {
+				return err
+			}
+		default:
+			return &ConfigError{Field: "assumeRoleBaseProvider", Reason: fmt.Sprintf("unsupported base authentication provider %d", dsConfig.AssumeRoleBaseProvider)}
+		}
+	case authProviderSharedConfig:
+		if dsConfig.Profile == "" {
+			return &ConfigError{Field: "profile", Reason: "is required for shared config authentication"}
+		}
+		if err := validateFile("credentialsFile", dsConfig.CredentialsFile); err != nil {
+			return err
+		}
+		if err := validateFile("configFile", dsConfig.ConfigFile); err != nil {
+			return err
+		}
+	case authProviderWebIdentity:
+		tokenFile, roleArn := dsConfig.webIdentity()
+		if tokenFile == "" {
+			return &ConfigError{Field: "webIdentityTokenFile", Reason: "is required for web identity authentication when AWS_WEB_IDENTITY_TOKEN_FILE is not set"}
+		}
+		if err := validateFile("webIdentityTokenFile", tokenFile); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(roleArn, "arn:") {
+			return &ConfigError{Field: "webIdentityRoleArn", Reason: "must be a role ARN for web identity authentication when AWS_ROLE_ARN is not set"}
+		}
+	default:
+		return &ConfigError{Field: "authenticationProvider", Reason: fmt.Sprintf("unknown authentication provider %d", dsConfig.AuthenticationProvider)}
+	}
+
+	if err := validateURL("endpoint", dsConfig.Endpoint); err != nil {
+		return err
+	}
+	if err := validateURL("stsEndpoint", dsConfig.StsEndpoint); err != nil {
+		return err
+	}
+	if err := validateURL("proxyUrl", dsConfig.ProxyURL); err != nil {
+		return err
+	}
+
+	for _, setting := range []struct {
+		field string
+		value int
+	}{
+		{"connectTimeout", dsConfig.ConnectTimeout},
+		{"responseTimeout", dsConfig.ResponseTimeout},
+		{"maxIdleConns", dsConfig.MaxIdleConns},
+		{"maxAttempts", dsConfig.MaxAttempts},
+	} {
+		if setting.value < 0 {
+			return &ConfigError{Field: setting.field, Reason: "must not be negative"}
+		}
+	}
+	switch dsConfig.RetryMode {
+	case "", retryModeStandard, retryModeOff:
+	default:
+		return &ConfigError{Field: "retryMode", Reason: fmt.Sprintf("unsupported retry mode %q, expected %q or %q", dsConfig.RetryMode, retryModeStandard, retryModeOff)}
+	}
+
+	return nil
+}
+
+// validateURL checks that an optional URL setting is an absolute http(s) URL.
+func validateURL(field string, value string) error {
+	if value == "" {
+		return nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return &ConfigError{Field: field, Reason: "is not a valid URL", Err: err}
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return &ConfigError{Field: field, Reason: fmt.Sprintf("%q must be an absolute http or https URL", value)}
+	}
+	return nil
+}
+
+// usePathStyle tells whether S3 clients address buckets path-style.
+func (dsConfig dataSourceConfig) usePathStyle() bool {
+	if dsConfig.ForcePathStyle == nil {
+		return dsConfig.Endpoint != ""
+	}
+	return *dsConfig.ForcePathStyle
+}
+
+// endpointResolverFunc points S3 at the custom endpoint and STS at the custom
+// STS endpoint, if set. Other services fall back to their default endpoints.
+// The S3 hostname is immutable unless virtual-hosted-style addressing is
+// explicitly selected, so that the bucket name stays in the path.
+func (dsConfig dataSourceConfig) endpointResolverFunc() config.LoadOptionsFunc {
+	if dsConfig.Endpoint == "" && dsConfig.StsEndpoint == "" {
+		return DummyLoadOptionsFunc()
+	}
+	return config.WithEndpointResolver(aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
+		if service == s3.ServiceID && dsConfig.Endpoint != "" {
+			return aws.Endpoint{
+				URL:               dsConfig.Endpoint,
+				HostnameImmutable: dsConfig.usePathStyle(),
+			}, nil
+		}
+		if service == sts.ServiceID && dsConfig.StsEndpoint != "" {
+			return aws.Endpoint{
+				URL:           dsConfig.StsEndpoint,
+				SigningRegion: region,
+			}, nil
+		}
+		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+	}))
+}
@@ -0,0 +1,163 @@
+package plugin
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// sizeBucketsPerOctave sets the resolution of sizeHistogram: with four buckets
+// per power of two, a percentile is estimated within about 9%.
+const sizeBucketsPerOctave = 4
+
+// sizeHistogram counts objects by size on a logarithmic scale, so that size
+// percentiles can be estimated from partitions merged at any interval. Bucket
+// 0 holds empty objects and bucket b > 0 sizes in
+// [2^((b-1)/sizeBucketsPerOctave), 2^(b/sizeBucketsPerOctave)).
+type sizeHistogram map[int]int64
+
+func sizeBucket(size int64) int {
+	if size <= 0 {
+		return 0
+	}
+	return 1 + int(math.Floor(math.Log2(float64(size))*sizeBucketsPerOctave))
+}
+
+// sizeBucketValue is the geometric middle of bucket b.
+func sizeBucketValue(b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return math.Exp2((float64(b) - 0.5) / sizeBucketsPerOctave)
+}
+
+// defaultStorageClass is assumed for objects listed without a storage
+// class, as some S3-compatible stores do.
+const defaultStorageClass = string(types.ObjectStorageClassStandard)
+
+// observe adds a listed object to the partition and to the summary of its
+// storage class.
+func (info *partitionInfo) observe(object types.Object) {
+	info.summarize(object)
+	class := string(object.StorageClass)
+	if class == "" {
+		class = defaultStorageClass
+	}
+	info.storageClass(class).summarize(object)
+}
+
+// storageClass returns the summary of the objects of class, creating it.
+func (info *partitionInfo) storageClass(class string) *partitionInfo {
+	if info.StorageClasses == nil {
+		info.StorageClasses = make(map[string]*partitionInfo)
+	}
+	classInfo, ok := info.StorageClasses[class]
+	if !ok {
+		classInfo = &partitionInfo{}
+		info.StorageClasses[class] = classInfo
+	}
+	return classInfo
+}
+
+func (info *partitionInfo) summarize(object types.Object) {
+	if info.NumberOfKeys == 0 || object.Size < info.MinSize {
+		info.MinSize = object.Size
+	}
+	if info.NumberOfKeys == 0 || object.Size > info.MaxSize {
+		info.MaxSize = object.Size
+	}
+	if object.LastModified != nil {
+		info.observeModified(*object.LastModified)
+	}
+	info.Size += object.Size
+	info.NumberOfKeys++
+	if info.SizeHistogram == nil {
+		info.SizeHistogram = make(sizeHistogram)
+	}
+	info.SizeHistogram[sizeBucket(object.Size)]++
+}
+
+func (info *partitionInfo) observeModified(t time.Time) {
+	if info.Newest.IsZero() || t.After(info.Newest) {
+		info.Newest = t
+	}
+	if info.Oldest.IsZero() || t.Before(info.Oldest) {
+		info.Oldest = t
+	}
+}
+
+// add merges other into info, as if the objects of both partitions had been
+// listed together. other is left untouched, since it may be cached.
+func (info *partitionInfo) add(other *partitionInfo) {
+	if other.NumberOfKeys > 0 {
+		if info.NumberOfKeys == 0 || other.MinSize < info.MinSize {
+			info.MinSize = other.MinSize
+		}
+		if info.NumberOfKeys == 0 || other.MaxSize > info.MaxSize {
+			info.MaxSize = other.MaxSize
+		}
+	}
+	if !other.Newest.IsZero() {
+		info.observeModified(other.Newest)
+		info.observeModified(other.Oldest)
+	}
+	info.Size += other.Size
+	info.NumberOfKeys += other.NumberOfKeys
+	info.NoncurrentSize += other.NoncurrentSize
+	info.NoncurrentVersions += other.NoncurrentVersions
+	info.DeleteMarkers += other.DeleteMarkers
+	info.Uploads += other.Uploads
+	info.UploadedBytes += other.UploadedBytes
+	if !other.OldestUpload.IsZero() && (info.OldestUpload.IsZero() || other.OldestUpload.Before(info.OldestUpload)) {
+		info.OldestUpload = other.OldestUpload
+	}
+	info.Truncated = info.Truncated || other.Truncated
+	for b, n := range other.SizeHistogram {
+		if info.SizeHistogram == nil {
+			info.SizeHistogram = make(sizeHistogram)
+		}
+		info.SizeHistogram[b] += n
+	}
+	for class, classInfo := range other.StorageClasses {
+		info.storageClass(class).add(classInfo)
+	}
+}
+
+// averageSize returns the mean object size, NaN for an empty partition.
+func (info *partitionInfo) averageSize() float64 {
+	if info.NumberOfKeys == 0 {
+		return math.NaN()
+	}
+	return float64(info.Size) / float64(info.NumberOfKeys)
+}
+
+// sizePercentile estimates the q-th quantile (0 < q <= 1) of the object
+// sizes from the histogram, NaN for an empty partition. Estimates are
+// clamped to the exact minimum and maximum sizes.
+func (info *partitionInfo) sizePercentile(q float64) float64 {
+	if info.NumberOfKeys == 0 {
+		return math.NaN()
+	}
+	buckets := make([]int, 0, len(info.SizeHistogram))
+	for b := range info.SizeHistogram {
+		buckets = append(buckets, b)
+	}
+	sort.Ints(buckets)
+
+	rank := int64(math.Ceil(q * float64(info.NumberOfKeys)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	estimate := float64(info.MaxSize)
+	for _, b := range buckets {
+		seen += info.SizeHistogram[b]
+		if seen >= rank {
+			estimate = sizeBucketValue(b)
+			break
+		}
+	}
+	return math.Max(float64(info.MinSize), math.Min(float64(info.MaxSize), estimate))
+}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// tlsConfig builds the TLS configuration of the HTTP client from the TLS
+// options; it returns nil when none is set, keeping the SDK defaults.
+func (dsConfig dataSourceConfig) tlsConfig(secureData map[string]string) (*tls.Config, error) {
+	if !dsConfig.TLSAuth && !dsConfig.TLSAuthWithCACert && !dsConfig.TLSSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Only meant for lab setups with self-signed certificates.
+		InsecureSkipVerify: dsConfig.TLSSkipVerify,
+	}
+
+	if dsConfig.TLSAuthWithCACert {
+		caCert := secureData["tlsCACert"]
+		if caCert == "" {
+			return nil, &ConfigError{Field: "tlsCACert", Reason: "is required when tlsAuthWithCACert is set"}
+		}
+		// The bundle extends the system roots, so that AWS endpoints such as
+		// STS keep working next to a custom S3 endpoint.
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(caCert)) {
+			return nil, &ConfigError{Field: "tlsCACert", Reason: "does not contain any PEM certificate"}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if dsConfig.TLSAuth {
+		if secureData["tlsClientCert"] == "" || secureData["tlsClientKey"] == "" {
+			return nil, &ConfigError{Field: "tlsClientCert", Reason: "and tlsClientKey are required when tlsAuth is set"}
+		}
+		cert, err := tls.X509KeyPair([]byte(secureData["tlsClientCert"]), []byte(secureData["tlsClientKey"]))
+		if err != nil {
+			return nil, &ConfigError{Field: "tlsClientCert", Reason: "and tlsClientKey are not a valid PEM key pair", Err: err}
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// httpClient builds the HTTP client shared by the S3 and STS clients of the
+// datasource from the TLS, proxy and connection options; it returns nil when
+// the SDK default client will do.
+func (dsConfig dataSourceConfig) httpClient(secureData map[string]string) (aws.HTTPClient, error) {
+	tlsConfig, err := dsConfig.tlsConfig(secureData)
+	if err != nil {
+		return nil, err
+	}
+	// validate has already rejected malformed proxy URLs.
+	proxyURL, _ := url.Parse(dsConfig.ProxyURL)
+	if tlsConfig == nil && dsConfig.ProxyURL == "" && dsConfig.ConnectTimeout == 0 && dsConfig.ResponseTimeout == 0 && dsConfig.MaxIdleConns == 0 {
+		return nil, nil
+	}
+
+	client := awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+		if tlsConfig != nil {
+			transport.TLSClientConfig = tlsConfig
+		}
+		if dsConfig.ProxyURL != "" {
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+		if dsConfig.MaxIdleConns > 0 {
+			// All requests go to the same few hosts, so the per-host limit
+			// matters as much as the total.
+			transport.MaxIdleConns = dsConfig.MaxIdleConns
+			transport.MaxIdleConnsPerHost = dsConfig.MaxIdleConns
+		}
+	})
+	if dsConfig.ConnectTimeout > 0 {
+		client = client.WithDialerOptions(func(dialer *net.Dialer) {
+			dialer.Timeout = time.Duration(dsConfig.ConnectTimeout) * time.Second
+		})
+	}
+	if dsConfig.ResponseTimeout > 0 {
+		client = client.WithTimeout(time.Duration(dsConfig.ResponseTimeout) * time.Second)
+	}
+	return client, nil
+}
+
+// httpClientFunc is the load option applying httpClient.
+func (dsConfig dataSourceConfig) httpClientFunc(secureData map[string]string) (config.LoadOptionsFunc, error) {
+	client, err := dsConfig.httpClient(secureData)
+	if err != nil || client == nil {
+		return DummyLoadOptionsFunc(), err
+	}
+	return config.WithHTTPClient(client), nil
+}
+
+// Retry modes; the SDK version in use only implements the standard mode.
+const (
+	retryModeStandard = "standard"
+	retryModeOff      = "off"
+)
+
+// retryerFunc is the load option applying the retry mode and max attempts.
+func (dsConfig dataSourceConfig) retryerFunc() config.LoadOptionsFunc {
+	switch {
+	case dsConfig.RetryMode == retryModeOff:
+		return config.WithRetryer(func() aws.Retryer {
+			return aws.NopRetryer{}
+		})
+	case dsConfig.MaxAttempts > 0:
+		return config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.MaxAttempts = dsConfig.MaxAttempts
+			})
+		})
+	}
+	return DummyLoadOptionsFunc()
+}
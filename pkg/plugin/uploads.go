@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"context"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3ListMultipartUploadsAPIClient is implemented by clients that can list
+// the multipart uploads in progress. The SDK has no paginator for it.
+type s3ListMultipartUploadsAPIClient interface {
+	ListMultipartUploads(context.Context, *s3.ListMultipartUploadsInput, ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+}
+
+// s3UploadsAPIClient lists multipart uploads and their parts.
+type s3UploadsAPIClient interface {
+	s3ListMultipartUploadsAPIClient
+	s3.ListPartsAPIClient
+}
+
+// errorCodeNoSuchUpload is the S3 error code of ListParts for an upload that
+// no longer exists.
+const errorCodeNoSuchUpload = "NoSuchUpload"
+
+// addUploadsInfo adds the multipart uploads in progress under prefix to info:
+// their number, the oldest initiation time and, with options.UploadParts, the
+// bytes of the parts uploaded so far. Uploads that end while their parts are
+// listed are skipped. options.MaxPages bounds the pages of uploads, and again
+// the pages of parts of all the uploads, which options.MaxKeys also bounds.
+func addUploadsInfo(ctx context.Context, client s3UploadsAPIClient, bucket string, prefix string, options listingOptions, info *partitionInfo) error {
+	input := &s3.ListMultipartUploadsInput{
+		Bucket:              aws.String(bucket),
+		Prefix:              aws.String(prefix),
+		ExpectedBucketOwner: options.expectedBucketOwner(),
+	}
+
+	var parts partsListed
+	for pages := 0; ; pages++ {
+		if options.MaxPages > 0 && pages >= options.MaxPages {
+			info.Truncated = true
+			break
+		}
+
+		output, err := client.ListMultipartUploads(ctx, input, options.requestPayerHeader()...)
+		if err != nil {
+			log.DefaultLogger.Error("addUploadsInfo called", "err", err)
+			return err
+		}
+
+		for _, upload := range output.Uploads {
+			if options.UploadParts {
+				size, err := uploadedBytes(ctx, client, bucket, aws.ToString(upload.Key), aws.ToString(upload.UploadId), options, &parts)
+				if s3ErrorCode(err) == errorCodeNoSuchUpload {
+					// The upload was completed or aborted since it was listed.
+					continue
+				}
+				if err != nil {
+					log.DefaultLogger.Error("addUploadsInfo called", "err", err)
+					return err
+				}
+				info.UploadedBytes += size
+				info.Truncated = info.Truncated || parts.truncated
+			}
+			info.Uploads++
+			if upload.Initiated != nil && (info.OldestUpload.IsZero() || upload.Initiated.Before(info.OldestUpload)) {
+				info.OldestUpload = *upload.Initiated
+			}
+		}
+
+		if !output.IsTruncated || output.NextKeyMarker == nil ||
+			(aws.ToString(output.NextKeyMarker) == aws.ToString(input.KeyMarker) && aws.ToString(output.NextUploadIdMarker) == aws.ToString(input.UploadIdMarker)) {
+			break
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.UploadIdMarker = output.NextUploadIdMarker
+	}
+	return nil
+}
+
+// partsListed counts the pages and parts listed for the uploads of a
+// partition, against the ceilings of listingOptions.
+type partsListed struct {
+	pages     int
+	parts     int64
+	truncated bool
+}
+
+// uploadedBytes returns the size of the parts of a multipart upload, as far
+// as the ceilings of options allow given the parts already listed.
+func uploadedBytes(ctx context.Context, client s3.ListPartsAPIClient, bucket string, key string, uploadID string, options listingOptions, listed *partsListed) (int64, error) {
+	paginator := s3.NewListPartsPaginator(client, &s3.ListPartsInput{
+		Bucket:              aws.String(bucket),
+		Key:                 aws.String(key),
+		UploadId:            aws.String(uploadID),
+		RequestPayer:        options.requestPayer(),
+		ExpectedBucketOwner: options.expectedBucketOwner(),
+	}, func(o *s3.ListPartsPaginatorOptions) {
+		o.StopOnDuplicateToken = true
+	})
+
+	var size int64
+	for paginator.HasMorePages() {
+		if (options.MaxPages > 0 && listed.pages >= options.MaxPages) || (options.MaxKeys > 0 && listed.parts >= options.MaxKeys) {
+			listed.truncated = true
+			break
+		}
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		listed.pages++
+
+		parts := output.Parts
+		if options.MaxKeys > 0 && listed.parts+int64(len(parts)) > options.MaxKeys {
+			parts = parts[:options.MaxKeys-listed.parts]
+			listed.truncated = true
+		}
+		for _, part := range parts {
+			size += part.Size
+		}
+		listed.parts += int64(len(parts))
+		if listed.truncated {
+			break
+		}
+	}
+	return size, nil
+}
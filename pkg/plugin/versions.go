@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"context"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3ListObjectVersionsAPIClient is implemented by clients that can list the
+// versions of the objects of a bucket. The SDK has no paginator for it.
+type s3ListObjectVersionsAPIClient interface {
+	ListObjectVersions(context.Context, *s3.ListObjectVersionsInput, ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+}
+
+// getVersionsInfo is getPartitionInfo for versioned buckets: the current
+// versions are summarized like objects, and the noncurrent versions and
+// delete markers are counted. The ceilings of options count every version and
+// delete marker as a key.
+func getVersionsInfo(ctx context.Context, client s3ListObjectVersionsAPIClient, bucket string, prefix string, options listingOptions) (*partitionInfo, error) {
+	var info partitionInfo
+	input := &s3.ListObjectVersionsInput{
+		Bucket:              aws.String(bucket),
+		Prefix:              aws.String(prefix),
+		ExpectedBucketOwner: options.expectedBucketOwner(),
+	}
+
+	var listed int64
+	for pages := 0; ; pages++ {
+		if (options.MaxPages > 0 && pages >= options.MaxPages) || (options.MaxKeys > 0 && listed >= options.MaxKeys) {
+			info.Truncated = true
+			break
+		}
+
+		if options.MaxKeys > 0 && options.MaxKeys-listed < 1000 {
+			input.MaxKeys = int32(options.MaxKeys - listed)
+		}
+		output, err := client.ListObjectVersions(ctx, input, options.requestPayerHeader()...)
+		if err != nil {
+			log.DefaultLogger.Error("getVersionsInfo called", "err", err)
+			return nil, err
+		}
+
+		for _, version := range output.Versions {
+			if version.IsLatest {
+				info.observe(types.Object{
+					Key:          version.Key,
+					Size:         version.Size,
+					LastModified: version.LastModified,
+					StorageClass: types.ObjectStorageClass(version.StorageClass),
+				})
+				continue
+			}
+			info.NoncurrentSize += version.Size
+			info.NoncurrentVersions++
+		}
+		info.DeleteMarkers += int64(len(output.DeleteMarkers))
+		listed += int64(len(output.Versions) + len(output.DeleteMarkers))
+
+		// Stop on a repeated marker, like the ListObjectsV2 paginator does
+		// on a duplicate token, rather than loop forever.
+		if !output.IsTruncated || output.NextKeyMarker == nil ||
+			(aws.ToString(output.NextKeyMarker) == aws.ToString(input.KeyMarker) && aws.ToString(output.NextVersionIdMarker) == aws.ToString(input.VersionIdMarker)) {
+			break
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.VersionIdMarker = output.NextVersionIdMarker
+	}
+
+	return &info, nil
+}
@@ -1,7 +1,7 @@
 import { defaults } from 'lodash';
 
 import React, { ChangeEvent, PureComponent } from 'react';
-import { InlineField, Input, LegacyForms, Select } from '@grafana/ui';
+import { InlineField, InlineSwitch, Input, LegacyForms, MultiSelect, Select, TagsInput } from '@grafana/ui';
 import { QueryEditorProps, SelectableValue } from '@grafana/data';
 import { DataSource } from './datasource';
 import { defaultQuery, MyDataSourceOptions, MyQuery } from './types';
@@ -11,8 +11,43 @@ const { FormField } = LegacyForms;
 type Props = QueryEditorProps<DataSource, MyQuery, MyDataSourceOptions>;
 
 const metricOptions = [
-  { label: 'Size', value: 0, description: 'Keys size in bytes' },
-  { label: 'Number of keys', value: 1, description: 'Number of keys' },
+  { label: 'Size', value: 'size', description: 'Keys size in bytes' },
+  { label: 'Number of keys', value: 'keys', description: 'Number of keys' },
+  { label: 'Average size', value: 'avg_size', description: 'Average object size in bytes' },
+  { label: 'Min size', value: 'min_size', description: 'Minimum object size in bytes' },
+  { label: 'Max size', value: 'max_size', description: 'Maximum object size in bytes' },
+  { label: 'Median size', value: 'p50_size', description: 'Median object size in bytes (estimated)' },
+  { label: 'p95 size', value: 'p95_size', description: '95th percentile object size in bytes (estimated)' },
+  { label: 'Newest object', value: 'newest_modified', description: 'Latest LastModified' },
+  { label: 'Oldest object', value: 'oldest_modified', description: 'Earliest LastModified' },
+  { label: 'Arrival latency', value: 'arrival_latency', description: 'Newest LastModified minus the partition time' },
+  { label: 'Noncurrent size', value: 'noncurrent_size', description: 'Size of noncurrent versions in bytes' },
+  { label: 'Noncurrent versions', value: 'noncurrent_versions', description: 'Number of noncurrent versions' },
+  { label: 'Delete markers', value: 'delete_markers', description: 'Number of delete markers' },
+  { label: 'Multipart uploads', value: 'uploads', description: 'Number of multipart uploads in progress' },
+  { label: 'Oldest upload age', value: 'oldest_upload_age', description: 'Age of the oldest multipart upload' },
+  { label: 'Uploaded bytes', value: 'uploaded_bytes', description: 'Bytes of the parts uploaded (lists every part)' },
+];
+
+// Older queries stored the metric as 0 (size) or 1 (number of keys).
+const metricId = (metric: string | number | undefined) =>
+  typeof metric === 'number' ? (metric === 0 ? 'size' : 'keys') : metric;
+
+const aggregateByOptions = [
+  { label: 'Raw', value: 'raw', description: 'One point per rendered prefix' },
+  { label: 'Hour', value: 'hour' },
+  { label: 'Day', value: 'day' },
+  { label: 'Week', value: 'week' },
+  { label: 'Month', value: 'month' },
+];
+
+const aggregationOptions = [
+  { label: 'Sum', value: 'sum' },
+  { label: 'Average', value: 'avg' },
+  { label: 'Min', value: 'min' },
+  { label: 'Max', value: 'max' },
+  { label: 'Last', value: 'last' },
+  { label: 'Merge', value: 'merge', description: 'Compute the metric over the merged partitions of the interval' },
 ];
 
 export class QueryEditor extends PureComponent<Props> {
@@ -26,14 +61,81 @@ export class QueryEditor extends PureComponent<Props> {
     onChange({ ...query, prefix: event.target.value });
   };
 
-  onMetricChange = (event: SelectableValue<number>) => {
+  onRegionChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, region: event.target.value });
+  };
+
+  onMetricsChange = (events: Array<SelectableValue<string>>) => {
+    const { onChange, query } = this.props;
+    const metrics = events.map((event) => event.value || 'size');
+    onChange({ ...query, metric: metrics[0] || 'size', metrics });
+  };
+
+  onAggregateByChange = (event: SelectableValue<string>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, aggregateBy: event.value });
+  };
+
+  onAggregationChange = (event: SelectableValue<string>) => {
+    const { onChange, query } = this.props;
+    // Clearing the aggregation falls back to the default of each metric.
+    onChange({ ...query, aggregation: event ? event.value : undefined });
+  };
+
+  onRequesterPaysChange = (event: React.FormEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, requesterPays: event.currentTarget.checked });
+  };
+
+  onExpectedBucketOwnerChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, expectedBucketOwner: event.target.value });
+  };
+
+  onGroupByChange = (groupBy: string[]) => {
     const { onChange, query } = this.props;
-    onChange({ ...query, metric: event.value || 0 });
+    onChange({ ...query, groupBy });
+  };
+
+  onSplitMatchesChange = (event: React.FormEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, splitMatches: event.currentTarget.checked });
+  };
+
+  onMaxMatchesChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, maxMatches: parseInt(event.target.value, 10) || undefined });
+  };
+
+  onByStorageClassChange = (event: React.FormEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, byStorageClass: event.currentTarget.checked });
+  };
+
+  onTimeoutChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, timeout: parseInt(event.target.value, 10) || undefined });
   };
 
   render() {
     const query = defaults(this.props.query, defaultQuery);
-    const { bucket, prefix, metric } = query;
+    const {
+      bucket,
+      prefix,
+      region,
+      metric,
+      metrics,
+      aggregateBy,
+      aggregation,
+      byStorageClass,
+      groupBy,
+      splitMatches,
+      maxMatches,
+      requesterPays,
+      expectedBucketOwner,
+      timeout,
+    } = query;
 
     return (
       <div className="gf-form">
@@ -41,8 +143,70 @@ export class QueryEditor extends PureComponent<Props> {
         <InlineField label="Prefix" tooltip="Prefix path in bucket" grow>
           <Input placeholder="Inline input" css={undefined} value={prefix || ''} onChange={this.onPrefixChange} />
         </InlineField>
-        <InlineField label="Metric" labelWidth={10}>
-          <Select options={metricOptions} width={20} value={metric} onChange={this.onMetricChange} />
+        <InlineField label="Region" tooltip="Leave blank to discover the bucket's region">
+          <Input width={16} placeholder="auto" css={undefined} value={region || ''} onChange={this.onRegionChange} />
+        </InlineField>
+        <InlineField label="Metrics" labelWidth={10}>
+          <MultiSelect
+            options={metricOptions}
+            width={30}
+            value={metrics && metrics.length > 0 ? metrics : [metricId(metric)]}
+            onChange={this.onMetricsChange}
+          />
+        </InlineField>
+        <InlineField label="Group by" labelWidth={10}>
+          <Select options={aggregateByOptions} width={12} value={aggregateBy} onChange={this.onAggregateByChange} />
+        </InlineField>
+        <InlineField label="Aggregation" labelWidth={12}>
+          <Select
+            options={aggregationOptions}
+            width={16}
+            value={aggregation}
+            placeholder="metric default"
+            isClearable
+            onChange={this.onAggregationChange}
+          />
+        </InlineField>
+        <InlineField label="Group by keys" tooltip="Keys of key=* prefix segments, one series per value">
+          <TagsInput placeholder="merge all" tags={groupBy || []} onChange={this.onGroupByChange} />
+        </InlineField>
+        <InlineField label="Split matches" tooltip="One series per match of the prefix globs">
+          <InlineSwitch value={splitMatches || false} onChange={this.onSplitMatchesChange} />
+        </InlineField>
+        <InlineField label="Max matches" tooltip="Most prefixes a rendered prefix with globs may expand to">
+          <Input
+            width={8}
+            type="number"
+            placeholder="100"
+            css={undefined}
+            value={maxMatches || ''}
+            onChange={this.onMaxMatchesChange}
+          />
+        </InlineField>
+        <InlineField label="By storage class" tooltip="One series per storage class">
+          <InlineSwitch value={byStorageClass || false} onChange={this.onByStorageClassChange} />
+        </InlineField>
+        <InlineField label="Requester pays" tooltip="Pay for the requests to a requester-pays bucket">
+          <InlineSwitch value={requesterPays || false} onChange={this.onRequesterPaysChange} />
+        </InlineField>
+        <InlineField label="Bucket owner" tooltip="Expected account ID of the bucket owner">
+          <Input
+            width={16}
+            placeholder="any"
+            css={undefined}
+            value={expectedBucketOwner || ''}
+            onChange={this.onExpectedBucketOwnerChange}
+          />
+        </InlineField>
+        <InlineField label="Timeout" tooltip="Seconds; partial results are returned when it expires">
+          <Input
+            width={8}
+            type="number"
+            placeholder="none"
+            css={undefined}
+            value={timeout || ''}
+            onChange={this.onTimeoutChange}
+          />
         </InlineField>
       </div>
     );
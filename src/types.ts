@@ -3,13 +3,29 @@ import { DataQuery, DataSourceJsonData } from '@grafana/data';
 export interface MyQuery extends DataQuery {
   bucket?: string;
   prefix: string;
-  metric: number;
+  region?: string;
+  // Metric ID; older queries hold 0 (size) or 1 (number of keys).
+  metric: string | number;
+  // Metric IDs computed from a single listing; replaces metric when set.
+  metrics?: string[];
+  maxPages?: number;
+  maxKeys?: number;
+  aggregateBy?: string;
+  aggregation?: string;
+  requesterPays?: boolean;
+  expectedBucketOwner?: string;
+  timeout?: number;
+  byStorageClass?: boolean;
+  groupBy?: string[];
+  splitMatches?: boolean;
+  maxMatches?: number;
 }
 
 export const defaultQuery: Partial<MyQuery> = {
   bucket: '',
   prefix: '/',
-  metric: 0,
+  metric: 'size',
+  aggregateBy: 'day',
 };
 
 /**
@@ -18,12 +34,47 @@ export const defaultQuery: Partial<MyQuery> = {
 export interface MyDataSourceOptions extends DataSourceJsonData {
   authenticationProvider: number;
   accessKeyId?: string;
+  sessionTokenExpiration?: string;
   endpoint?: string;
+  forcePathStyle?: boolean;
+  tlsAuth?: boolean;
+  tlsAuthWithCACert?: boolean;
+  tlsSkipVerify?: boolean;
+  proxyUrl?: string;
+  connectTimeout?: number;
+  responseTimeout?: number;
+  maxIdleConns?: number;
+  retryMode?: string;
+  maxAttempts?: number;
+  stsEndpoint?: string;
+  defaultRegion?: string;
+  assumeRoleArn?: string;
+  externalId?: string;
+  assumeRoleSessionName?: string;
+  assumeRoleDuration?: number;
+  assumeRoleBaseProvider?: number;
+  profile?: string;
+  credentialsFile?: string;
+  configFile?: string;
+  webIdentityTokenFile?: string;
+  webIdentityRoleArn?: string;
+  concurrency?: number;
+  defaultBucket?: string;
+  requesterPays?: boolean;
+  expectedBucketOwner?: string;
+  cacheMaxEntries?: number;
+  openPartitionCacheTTL?: number;
+  closedPartitionCacheTTL?: number;
 }
 
 /**
  * Value that is used in the backend, but never sent over HTTP to the frontend
  */
 export interface MySecureJsonData {
+  accessKeyId?: string;
   secretAccessKey?: string;
+  sessionToken?: string;
+  tlsCACert?: string;
+  tlsClientCert?: string;
+  tlsClientKey?: string;
 }